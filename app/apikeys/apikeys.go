@@ -0,0 +1,102 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"gorm.io/gorm"
+)
+
+// Header is where clients present their key.
+const Header = "X-API-Key"
+
+// Keys look like gak_<prefix>_<secret>. The prefix is stored in clear so
+// users can tell their keys apart in listings.
+const keyPrefix = "gak_"
+
+// How stale last_used_at may get before a request updates it, so busy keys
+// don't write to the database on every request.
+const lastUsedGranularity = time.Minute
+
+var ErrInvalidKey = errors.New("Invalid API key")
+
+// Generate returns a new key along with the prefix and hash to store.
+func Generate() (key, prefix, hash string, err error) {
+	p := make([]byte, 6)
+	if _, err = rand.Read(p); err != nil {
+		return "", "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+
+	prefix = keyPrefix + hex.EncodeToString(p)
+	key = prefix + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return key, prefix, Hash(key), nil
+}
+
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Resolve looks up a presented key and its owner, rejecting revoked and
+// expired keys and keys whose owner has left the key's organization, and
+// records that the key was used.
+func Resolve(db *gorm.DB, key string) (*models.APIKey, *models.User, error) {
+	if !strings.HasPrefix(key, keyPrefix) {
+		return nil, nil, ErrInvalidKey
+	}
+
+	apiKey := new(models.APIKey)
+	err := db.Where("key_hash = ?", Hash(key)).First(apiKey).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidKey
+		}
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt)) {
+		return nil, nil, ErrInvalidKey
+	}
+
+	user := new(models.User)
+	err = db.First(user, apiKey.UserID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidKey
+		}
+		return nil, nil, err
+	}
+	if user.DisabledAt != nil {
+		return nil, nil, ErrInvalidKey
+	}
+
+	if apiKey.OrganizationID != 0 {
+		var members int64
+		err = db.Model(&models.OrganizationMember{}).
+			Where("organization_id = ? AND user_id = ?", apiKey.OrganizationID, user.ID).
+			Count(&members).Error
+		if err != nil {
+			return nil, nil, err
+		}
+		if members == 0 {
+			return nil, nil, ErrInvalidKey
+		}
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > lastUsedGranularity {
+		db.Model(apiKey).Update("last_used_at", now)
+	}
+
+	return apiKey, user, nil
+}
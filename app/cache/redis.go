@@ -2,7 +2,7 @@ package cache
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
 
 	"github.com/go-redis/redis/v8"
@@ -27,10 +27,11 @@ func ConnectRedis() {
 	ctx := context.Background()
 	_, err := rdb.Ping(ctx).Result()
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		slog.Error("Failed to connect to Redis", "error", err)
+		os.Exit(2)
 	}
 
-	log.Println("Connected to Redis")
+	slog.Info("Connected to Redis")
 
 	RedisClient = RedisInstance{
 		Client: rdb,
@@ -1,31 +1,135 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/config"
 	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/handlers"
+	"github.com/capgainschristian/go_api_ds/jobs"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/logging"
+	"github.com/capgainschristian/go_api_ds/mail"
+	"github.com/capgainschristian/go_api_ds/metrics"
+	"github.com/capgainschristian/go_api_ds/oidc"
+	"github.com/capgainschristian/go_api_ds/outbox"
 	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/capgainschristian/go_api_ds/webhooks"
 )
 
 const PORT = 3000
 
 func main() {
+	enableSeedEndpoints := flag.Bool("enable-seed-endpoints", false,
+		"serve unauthenticated endpoints for loading fake data; only allowed when APP_ENV is development")
+	flag.Parse()
+
+	logging.Setup()
+
+	if *enableSeedEndpoints && config.IsProduction() {
+		slog.Error("--enable-seed-endpoints can only be used when APP_ENV is development")
+		os.Exit(2)
+	}
+
+	if config.IsProduction() && os.Getenv("METRICS_TOKEN") == "" {
+		slog.Error("METRICS_TOKEN must be set unless APP_ENV is development")
+		os.Exit(2)
+	}
+
+	if err := keys.LoadDefault(); err != nil {
+		slog.Error("Failed to load JWT keys", "error", err)
+		os.Exit(2)
+	}
+
+	if sso, ok := oidc.ConfigFromEnv(); ok {
+		if err := sso.Validate(); err != nil {
+			slog.Error("Invalid single sign-on configuration", "error", err)
+			os.Exit(2)
+		}
+	}
+
+	if err := mail.LoadDefault(); err != nil {
+		slog.Error("Failed to set up mail", "error", err)
+		os.Exit(2)
+	}
 
 	database.ConnectDb()
 
 	cache.ConnectRedis()
 
+	if err := metrics.RegisterStores(); err != nil {
+		slog.Error("Failed to register database metrics", "error", err)
+		os.Exit(2)
+	}
+
+	workers, err := strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil {
+		workers = 4
+	}
+	webhooks.RegisterJobs(database.DB.Db)
+	handlers.RegisterJobs()
+
+	pool := jobs.NewPool(database.DB.Db, workers)
+	pool.Start()
+
+	relay := outbox.NewRelay(database.DB.Db, cache.RedisClient.Client, os.Getenv("OUTBOX_STREAM"))
+	relay.Start()
+
+	dispatcher := webhooks.NewDispatcher(database.DB.Db, cache.RedisClient.Client, relay.Stream())
+	dispatcher.Start()
+
 	router := routes.SetupRouter()
+	if *enableSeedEndpoints {
+		slog.Warn("Seed endpoints are enabled; anyone who can reach the server can write customers", "env", config.Environment())
+		routes.RegisterSeedEndpoints(router)
+	}
 
-	log.Printf("Server listening on :%d...\n", PORT)
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", PORT),
+		Handler: router,
+	}
 
-	err := http.ListenAndServe(fmt.Sprintf(":%d", PORT), router)
+	go func() {
+		slog.Info("Server listening", "port", PORT)
 
-	if err != nil {
-		log.Fatal(err)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	slog.Info("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.ErrorContext(ctx, "HTTP shutdown error", "error", err)
+	}
+	if err := dispatcher.Stop(ctx); err != nil {
+		slog.ErrorContext(ctx, "Webhook dispatcher shutdown error", "error", err)
+	}
+	if err := pool.Stop(ctx); err != nil {
+		slog.ErrorContext(ctx, "Job pool shutdown error", "error", err)
+	}
+	if err := relay.Stop(ctx); err != nil {
+		slog.ErrorContext(ctx, "Outbox relay shutdown error", "error", err)
 	}
 
 }
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Duration reads a Go duration ("15m", "720h") from the environment,
+// falling back to def when the variable is unset or invalid.
+func Duration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		slog.Warn("Invalid setting, using the default", "key", key, "value", value, "default", def.String())
+		return def
+	}
+	return d
+}
+
+// AccessTokenTTL is how long a JWT issued by Login or /token/refresh is valid.
+func AccessTokenTTL() time.Duration {
+	return Duration("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// RefreshTokenTTL is how long a refresh token can be used to get new tokens.
+func RefreshTokenTTL() time.Duration {
+	return Duration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+// Int reads an integer from the environment, falling back to def when the
+// variable is unset or invalid.
+func Int(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		slog.Warn("Invalid setting, using the default", "key", key, "value", value, "default", def)
+		return def
+	}
+	return n
+}
+
+// PasswordResetTTL is how long a password reset link can be used.
+func PasswordResetTTL() time.Duration {
+	return Duration("PASSWORD_RESET_TTL", time.Hour)
+}
+
+// EmailVerificationTTL is how long the link sent at signup can be used.
+func EmailVerificationTTL() time.Duration {
+	return Duration("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+}
+
+// Environment is APP_ENV, such as "development" or "production". It is
+// "production" when unset, so a deployment that forgets to set it doesn't
+// get development behavior.
+func Environment() string {
+	if env := os.Getenv("APP_ENV"); env != "" {
+		return env
+	}
+	return "production"
+}
+
+// IsProduction reports whether development-only behavior must be refused,
+// which is always unless APP_ENV is exactly "development".
+func IsProduction() bool {
+	return Environment() != "development"
+}
@@ -2,13 +2,13 @@ package database
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 
+	"github.com/capgainschristian/go_api_ds/logging"
 	"github.com/capgainschristian/go_api_ds/models"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
 type Dbinstance struct {
@@ -26,22 +26,99 @@ func ConnectDb() {
 	)
 
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger: logging.NewGORM(),
+		// Report constraint violations as gorm.ErrDuplicatedKey and friends.
+		TranslateError: true,
 	})
 
 	if err != nil {
-		log.Fatal("Failed to connect to database. \n", err)
+		slog.Error("Failed to connect to database", "error", err)
 		os.Exit(2)
 	}
 
-	log.Println("Connected.")
-	db.Logger = logger.Default.LogMode(logger.Info)
+	slog.Info("Connected to database")
 
-	log.Println("Running migrations")
+	slog.Info("Running migrations")
+	db.AutoMigrate(&models.Organization{})
+	db.AutoMigrate(&models.OrganizationMember{})
 	db.AutoMigrate(&models.Customer{})
+	addingVerification := !db.Migrator().HasColumn(&models.User{}, "email_verified_at")
+	addingOIDCIssuer := !db.Migrator().HasColumn(&models.User{}, "oidc_issuer")
 	db.AutoMigrate(&models.User{})
+	migrateAdminFlag(db)
+	if addingOIDCIssuer {
+		migrateOIDCIssuer(db)
+	}
+	if addingVerification {
+		// Users from before email verification existed keep working.
+		db.Exec("UPDATE users SET email_verified_at = NOW() WHERE email_verified_at IS NULL")
+	}
+	db.AutoMigrate(&models.AuditLog{})
+	db.AutoMigrate(&models.Job{})
+	db.AutoMigrate(&models.CustomerHistory{})
+	db.AutoMigrate(&models.OutboxEvent{})
+	db.AutoMigrate(&models.WebhookEndpoint{})
+	db.AutoMigrate(&models.WebhookDelivery{})
+	db.AutoMigrate(&models.RefreshToken{})
+	db.AutoMigrate(&models.APIKey{})
+	db.AutoMigrate(&models.PasswordResetToken{})
+	db.AutoMigrate(&models.EmailVerificationToken{})
+	db.AutoMigrate(&models.RecoveryCode{})
+	db.AutoMigrate(&models.MFARequirement{})
+	migrateOrganizations(db)
 
 	DB = Dbinstance{
 		Db: db,
 	}
 }
+
+// migrateAdminFlag turns the old users.is_admin flag into the admin role.
+func migrateAdminFlag(db *gorm.DB) {
+	if !db.Migrator().HasColumn(&models.User{}, "is_admin") {
+		return
+	}
+
+	slog.Info("Migrating users.is_admin to users.role")
+	db.Exec("UPDATE users SET role = ? WHERE is_admin", models.RoleAdmin)
+	db.Migrator().DropColumn(&models.User{}, "is_admin")
+}
+
+// migrateOIDCIssuer records the configured issuer on identities linked
+// before the issuer was stored, and drops the old index on the subject alone.
+func migrateOIDCIssuer(db *gorm.DB) {
+	if db.Migrator().HasIndex(&models.User{}, "idx_users_oidc_subject") {
+		db.Migrator().DropIndex(&models.User{}, "idx_users_oidc_subject")
+	}
+
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		slog.Info("Recording the single sign-on issuer on linked users")
+		db.Exec("UPDATE users SET oidc_issuer = ? WHERE oidc_subject IS NOT NULL AND oidc_issuer IS NULL", issuer)
+	}
+}
+
+// migrateOrganizations moves everything from before organizations existed
+// into a "Default" organization with every existing user as a member, and
+// drops the old globally unique index on customer emails.
+func migrateOrganizations(db *gorm.DB) {
+	if db.Migrator().HasIndex(&models.Customer{}, "idx_customers_email") {
+		db.Migrator().DropIndex(&models.Customer{}, "idx_customers_email")
+	}
+
+	var count int64
+	db.Model(&models.Organization{}).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	slog.Info("Creating the default organization")
+	org := models.Organization{Name: "Default"}
+	if err := db.Create(&org).Error; err != nil {
+		slog.Error("Failed to create the default organization", "error", err)
+		return
+	}
+
+	for _, table := range []string{"customers", "customer_histories", "outbox_events", "webhook_endpoints", "api_keys", "refresh_tokens", "jobs"} {
+		db.Exec("UPDATE "+table+" SET organization_id = ? WHERE organization_id = 0", org.ID)
+	}
+	db.Exec("INSERT INTO organization_members (organization_id, user_id, created_at) SELECT ?, id, NOW() FROM users", org.ID)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"sync"
 
@@ -18,6 +20,27 @@ type Customer struct {
 }
 
 func main() {
+	apiURL := flag.String("url", "http://localhost:3000", "base URL of the API")
+	useSeedEndpoints := flag.Bool("seed-endpoints", false,
+		"add customers through /seed/customers, served by a development server started with --enable-seed-endpoints")
+	flag.Parse()
+
+	// Customers are added through /addcustomer as a user with the
+	// customers:write permission, identified by an API key or an access
+	// token, unless the unauthenticated seed endpoint was asked for.
+	endpoint := *apiURL + "/addcustomer"
+	var authHeader string
+	switch {
+	case *useSeedEndpoints:
+		endpoint = *apiURL + "/seed/customers"
+	case os.Getenv("SEED_API_KEY") != "":
+		authHeader = "X-API-Key: " + os.Getenv("SEED_API_KEY")
+	case os.Getenv("SEED_TOKEN") != "":
+		authHeader = "Authorization: Bearer " + os.Getenv("SEED_TOKEN")
+	default:
+		log.Fatal("Set SEED_API_KEY to an API key with the customers:write scope, or SEED_TOKEN to an access token, or pass -seed-endpoints")
+	}
+
 	gofakeit.Seed(0)
 
 	numDataPoints := 100
@@ -56,12 +79,16 @@ func main() {
 				return
 			}
 
-			curlCommand := exec.Command("curl",
+			args := []string{
+				"--fail",
 				"--header", "Content-Type: application/json",
 				"--request", "POST",
 				"--data", string(jsonData),
-				"http://localhost:3000/customercreation",
-			)
+			}
+			if authHeader != "" {
+				args = append(args, "--header", authHeader)
+			}
+			curlCommand := exec.Command("curl", append(args, endpoint)...)
 
 			output, err := curlCommand.CombinedOutput()
 			if err != nil {
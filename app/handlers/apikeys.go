@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/apikeys"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type apiKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// apiKeyCreatedResponse is the only time the key itself is returned.
+type apiKeyCreatedResponse struct {
+	models.APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey issues a named key for the current user, limited to scopes
+// the user's role already grants.
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	// A leaked key must not be able to mint more keys.
+	if middleware.AuthMethod(r) == middleware.AuthMethodAPIKey {
+		http.Error(w, "API keys cannot create API keys", http.StatusForbidden)
+		return
+	}
+
+	// Otherwise a key would be a way around the 2FA policy.
+	satisfied, err := middleware.MFASatisfied(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !satisfied {
+		http.Error(w, "Your role requires two-factor authentication; enroll at /mfa/totp/enroll and log in again", http.StatusForbidden)
+		return
+	}
+
+	var req apiKeyRequest
+
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, "Missing API key name", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "Missing API key scopes", http.StatusBadRequest)
+		return
+	}
+
+	granted := map[string]bool{}
+	for _, p := range middleware.Permissions(middleware.Roles(r)) {
+		granted[p] = true
+	}
+	for _, scope := range req.Scopes {
+		if !granted[scope] {
+			http.Error(w, "Scope not granted by your role: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "API key expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	key, prefix, hash, err := apikeys.Generate()
+	if err != nil {
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+
+	scopes, _ := json.Marshal(req.Scopes)
+
+	apiKey := models.APIKey{
+		UserID:         user.ID,
+		OrganizationID: middleware.OrganizationID(r),
+		Name:           req.Name,
+		Prefix:         prefix,
+		KeyHash:        hash,
+		Scopes:         scopes,
+		ExpiresAt:      req.ExpiresAt,
+	}
+
+	err = database.DB.Db.Create(&apiKey).Error
+	if err != nil {
+		http.Error(w, "Failed to add API key to the database", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(apiKeyCreatedResponse{APIKey: apiKey, Key: key})
+	if err != nil {
+		http.Error(w, "Failed to serialize API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResponse)
+}
+
+// ListAPIKeys lists the current user's keys, including revoked ones.
+func ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	apiKeys := []models.APIKey{}
+
+	err := database.DB.Db.Where("user_id = ?", user.ID).Order("id").Find(&apiKeys).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, apiKeys)
+}
+
+// RevokeAPIKey stops a key from working. The row is kept for auditing.
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid API key id", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	result := database.DB.Db.Model(&models.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, user.ID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("API key revoked successfully."))
+}
+
+// currentUser loads the authenticated user. It writes the error response
+// itself.
+func currentUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	user := new(models.User)
+
+	err := database.DB.Db.Where("email = ?", middleware.Subject(r)).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,104 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	email := "integration@grahamsummitllc.com"
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	user := models.User{Email: email, Password: "unused", Role: models.RoleEditor}
+	if err := database.DB.Db.Create(&user).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+	orgID := testOrganization(t)
+	database.DB.Db.Create(&models.OrganizationMember{OrganizationID: orgID, UserID: user.ID})
+
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   email,
+		"roles": []string{models.RoleEditor},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"org":   orgID,
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	send := func(method, path string, header http.Header, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	withToken := http.Header{"Authorization": {"Bearer " + tokenString}}
+
+	// Scopes beyond the user's role are refused.
+	rr := send("POST", "/apikeys", withToken, map[string]interface{}{"name": "too much", "scopes": []string{"users:admin"}})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = send("POST", "/apikeys", withToken, map[string]interface{}{"name": "nightly export", "scopes": []string{"customers:read"}})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var created struct {
+		ID     uint   `json:"ID"`
+		Key    string `json:"key"`
+		Prefix string `json:"prefix"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Contains(t, created.Key, created.Prefix)
+
+	withKey := http.Header{"X-Api-Key": {created.Key}}
+
+	rr = send("GET", "/customers/1/history", withKey, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The editor role allows writes, but the key is only scoped for reads.
+	rr = send("POST", "/addcustomer", withKey, models.Customer{Name: "Nope", Email: "nope@grahamsummitllc.com", Address: "Nowhere"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// Keys cannot mint more keys.
+	rr = send("POST", "/apikeys", withKey, map[string]interface{}{"name": "child", "scopes": []string{"customers:read"}})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	var stored models.APIKey
+	database.DB.Db.First(&stored, created.ID)
+	assert.NotNil(t, stored.LastUsedAt)
+	assert.NotEqual(t, created.Key, stored.KeyHash)
+
+	// Leaving the organization invalidates the key.
+	database.DB.Db.Where("user_id = ?", user.ID).Delete(&models.OrganizationMember{})
+	rr = send("GET", "/customers/1/history", withKey, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	database.DB.Db.Create(&models.OrganizationMember{OrganizationID: orgID, UserID: user.ID})
+
+	rr = send("DELETE", "/apikeys/"+strconv.FormatUint(uint64(created.ID), 10), withToken, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = send("GET", "/customers/1/history", withKey, nil)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
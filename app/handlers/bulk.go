@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/redaction"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const bulkConfirmationTTL = 5 * time.Minute
+
+var errBulkPlanStale = errors.New("matched customers changed since the dry run")
+
+// bulkRequest is the body accepted by the bulk endpoints. Without a
+// confirmation token the request is a dry run; with one, the plan stored
+// during the dry run is executed.
+type bulkRequest struct {
+	ConfirmationToken string `json:"confirmation_token"`
+	Name              string `json:"name"`
+	Address           string `json:"address"`
+	Number            int    `json:"number"`
+}
+
+// bulkPlan is what a dry run stores in Redis under its confirmation token.
+type bulkPlan struct {
+	Operation      string           `json:"operation"`
+	Actor          string           `json:"actor"`
+	OrganizationID uint             `json:"organization_id"`
+	Filter         customerFilter   `json:"filter"`
+	Updates        *models.Customer `json:"updates,omitempty"`
+	Count          int64            `json:"count"`
+	// IDs are the customers matched by the dry run, in order. The confirmed
+	// operation only goes ahead if the filter still matches exactly these.
+	IDs []uint `json:"ids"`
+}
+
+type bulkDryRunResponse struct {
+	Operation         string         `json:"operation"`
+	Filter            customerFilter `json:"filter"`
+	Count             int64          `json:"count"`
+	ConfirmationToken string         `json:"confirmation_token"`
+	ExpiresAt         time.Time      `json:"expires_at"`
+}
+
+type bulkResultResponse struct {
+	Operation string `json:"operation"`
+	Affected  int    `json:"affected"`
+}
+
+// BulkDeleteCustomers deletes every customer matching the list filter in the
+// query string. The first call is a dry run returning the match count and a
+// confirmation token; presenting the token executes the delete.
+func BulkDeleteCustomers(w http.ResponseWriter, r *http.Request) {
+	bulkOperation(w, r, "delete")
+}
+
+// BulkUpdateCustomers applies the name/address/number in the body to every
+// customer matching the list filter. Like UpdateCustomer, empty fields are
+// left untouched. It uses the same dry run/confirm flow as BulkDeleteCustomers.
+func BulkUpdateCustomers(w http.ResponseWriter, r *http.Request) {
+	bulkOperation(w, r, "update")
+}
+
+func bulkOperation(w http.ResponseWriter, r *http.Request, operation string) {
+	var req bulkRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	actor := middleware.Subject(r)
+	orgID := middleware.OrganizationID(r)
+	ctx := context.Background()
+
+	if req.ConfirmationToken != "" {
+		executeBulkPlan(ctx, w, actor, orgID, operation, req.ConfirmationToken)
+		return
+	}
+
+	filter, err := parseCustomerFilter(r.URL.Query(), redaction.ForRoles(middleware.Roles(r)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Refuse to act on the whole table by accident.
+	if filter.IsEmpty() {
+		http.Error(w, "Bulk operations require at least one filter", http.StatusBadRequest)
+		return
+	}
+
+	plan := bulkPlan{
+		Operation:      operation,
+		Actor:          actor,
+		OrganizationID: orgID,
+		Filter:         filter,
+	}
+
+	if operation == "update" {
+		if req.Name == "" && req.Address == "" && req.Number == 0 {
+			http.Error(w, "Nothing to update", http.StatusBadRequest)
+			return
+		}
+		plan.Updates = &models.Customer{
+			Name:      req.Name,
+			Address:   req.Address,
+			Number:    req.Number,
+			UpdatedBy: actor,
+		}
+	}
+
+	err = filter.Apply(customersIn(database.DB.Db, r)).Order("id").Pluck("id", &plan.IDs).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	plan.Count = int64(len(plan.IDs))
+
+	token, err := newConfirmationToken()
+	if err != nil {
+		http.Error(w, "Failed to create confirmation token", http.StatusInternalServerError)
+		return
+	}
+
+	planJSON, err := json.Marshal(plan)
+	if err != nil {
+		http.Error(w, "Failed to serialize bulk plan", http.StatusInternalServerError)
+		return
+	}
+
+	err = cache.RedisClient.Client.Set(ctx, "bulk:confirm:"+token, planJSON, bulkConfirmationTTL).Err()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Redis SET error", "error", err)
+		http.Error(w, "Failed to store confirmation token", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(bulkDryRunResponse{
+		Operation:         operation,
+		Filter:            filter,
+		Count:             plan.Count,
+		ConfirmationToken: token,
+		ExpiresAt:         time.Now().Add(bulkConfirmationTTL).UTC(),
+	})
+	if err != nil {
+		http.Error(w, "Failed to serialize dry run", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+func executeBulkPlan(ctx context.Context, w http.ResponseWriter, actor string, orgID uint, operation, token string) {
+	// GETDEL makes the token single use even if two requests race.
+	planJSON, err := cache.RedisClient.Client.GetDel(ctx, "bulk:confirm:"+token).Result()
+	if err == redis.Nil {
+		http.Error(w, "Invalid or expired confirmation token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Redis GETDEL error", "error", err)
+		http.Error(w, "Failed to retrieve confirmation token", http.StatusInternalServerError)
+		return
+	}
+
+	var plan bulkPlan
+	err = json.Unmarshal([]byte(planJSON), &plan)
+	if err != nil {
+		http.Error(w, "Failed to deserialize bulk plan", http.StatusInternalServerError)
+		return
+	}
+
+	if plan.Operation != operation || plan.Actor != actor || plan.OrganizationID != orgID {
+		http.Error(w, "Invalid or expired confirmation token", http.StatusBadRequest)
+		return
+	}
+
+	var emails []string
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		customers := []models.Customer{}
+
+		inOrg := models.InOrganization(orgID)
+
+		err := plan.Filter.Apply(tx.Model(&models.Customer{}).Scopes(inOrg)).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Order("id").
+			Find(&customers).Error
+		if err != nil {
+			return err
+		}
+
+		// The same number of matches isn't enough: one customer may have
+		// been deleted and another created since the dry run.
+		if len(customers) != len(plan.IDs) {
+			return errBulkPlanStale
+		}
+		for i := range customers {
+			if customers[i].ID != plan.IDs[i] {
+				return errBulkPlanStale
+			}
+		}
+
+		for i := range customers {
+			before := customers[i]
+			emails = append(emails, before.Email)
+
+			switch plan.Operation {
+			case "delete":
+				err = recordCustomerChange(tx, actor, historyDelete, &before, nil)
+			case "update":
+				after := before
+				if plan.Updates.Name != "" {
+					after.Name = plan.Updates.Name
+				}
+				if plan.Updates.Address != "" {
+					after.Address = plan.Updates.Address
+				}
+				if plan.Updates.Number != 0 {
+					after.Number = plan.Updates.Number
+				}
+				err = recordCustomerChange(tx, actor, historyUpdate, &before, &after)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		switch plan.Operation {
+		case "delete":
+			err = tx.Unscoped().Scopes(inOrg).Where("email IN ?", emails).Delete(&models.Customer{}).Error
+		case "update":
+			err = tx.Model(&models.Customer{}).Scopes(inOrg).Where("email IN ?", emails).Updates(plan.Updates).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		details, err := json.Marshal(map[string]interface{}{
+			"filter":  plan.Filter,
+			"updates": plan.Updates,
+			"emails":  emails,
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&models.AuditLog{
+			Actor:     actor,
+			Operation: "bulk_" + plan.Operation,
+			Details:   details,
+		}).Error
+	})
+	if err != nil {
+		if errors.Is(err, errBulkPlanStale) {
+			http.Error(w, "Matched customers changed since the dry run; request a new confirmation token", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to "+plan.Operation+" customers in database", http.StatusInternalServerError)
+		return
+	}
+
+	err = invalidateCustomerCache(ctx, orgID, emails)
+	if err != nil {
+		slog.ErrorContext(ctx, "Redis DEL error", "error", err)
+		http.Error(w, "Failed to invalidate cache", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(bulkResultResponse{
+		Operation: plan.Operation,
+		Affected:  len(emails),
+	})
+	if err != nil {
+		http.Error(w, "Failed to serialize result", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+// invalidateCustomerCache drops the organization's per-customer entries for
+// the given emails and every cached page of its ListCustomers, since any of
+// them may be stale.
+func invalidateCustomerCache(ctx context.Context, orgID uint, emails []string) error {
+	keys := make([]string, 0, len(emails))
+	for _, email := range emails {
+		keys = append(keys, customerCacheKey(orgID, email))
+	}
+
+	iter := cache.RedisClient.Client.Scan(ctx, 0, tenantCachePrefix(orgID)+"customers:*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	return cache.RedisClient.Client.Del(ctx, keys...).Err()
+}
+
+func newConfirmationToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
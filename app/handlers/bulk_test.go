@@ -0,0 +1,178 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkDeleteCustomers(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	database.DB.Db.Unscoped().Where("email LIKE ?", "%@bulk-spam.example").Delete(&models.Customer{})
+	for _, email := range []string{"one@bulk-spam.example", "two@bulk-spam.example"} {
+		customer := models.Customer{OrganizationID: testOrganization(t), Name: "Spam", Email: email, Address: "Nowhere", Number: 1}
+		if err := database.DB.Db.Create(&customer).Error; err != nil {
+			t.Fatal("Failed to create customer:", err)
+		}
+	}
+
+	ensureTestUser(t, "bulk.admin@grahamsummitllc.com")
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   "bulk.admin@grahamsummitllc.com",
+		"roles": []string{models.RoleAdmin},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"csrf":  testCSRF,
+		"org":   testOrganization(t),
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	// Dry run
+	req, err := http.NewRequest("DELETE", "/bulkdeletecustomers?email=*@bulk-spam.example", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+	req.Header.Set(middleware.CSRFHeader, testCSRF)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var dryRun struct {
+		Count             int64  `json:"count"`
+		ConfirmationToken string `json:"confirmation_token"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &dryRun))
+	assert.Equal(t, int64(2), dryRun.Count)
+	assert.NotEmpty(t, dryRun.ConfirmationToken)
+
+	// Confirm
+	body, _ := json.Marshal(map[string]string{"confirmation_token": dryRun.ConfirmationToken})
+	req, err = http.NewRequest("DELETE", "/bulkdeletecustomers", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+	req.Header.Set(middleware.CSRFHeader, testCSRF)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var count int64
+	database.DB.Db.Model(&models.Customer{}).Where("email LIKE ?", "%@bulk-spam.example").Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	// The token is single use
+	req, _ = http.NewRequest("DELETE", "/bulkdeletecustomers", bytes.NewBuffer(body))
+	req.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+	req.Header.Set(middleware.CSRFHeader, testCSRF)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestBulkDeleteCustomersRequiresAdmin(t *testing.T) {
+	ensureTestUser(t, "admin@grahamsummitllc.com")
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   "admin@grahamsummitllc.com",
+		"roles": []string{models.RoleEditor},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"csrf":  testCSRF,
+		"org":   testOrganization(t),
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	req, err := http.NewRequest("DELETE", "/bulkdeletecustomers?email=*", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+	req.Header.Set(middleware.CSRFHeader, testCSRF)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+	assert.Contains(t, rr.Body.String(), "customers:bulk")
+}
+
+func TestBulkDeleteCustomersRejectsSwappedMatches(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	orgID := testOrganization(t)
+	database.DB.Db.Unscoped().Where("email LIKE ?", "%@bulk-swap.example").Delete(&models.Customer{})
+	defer database.DB.Db.Unscoped().Where("email LIKE ?", "%@bulk-swap.example").Delete(&models.Customer{})
+	database.DB.Db.Create(&models.Customer{OrganizationID: orgID, Name: "Old", Email: "old@bulk-swap.example"})
+
+	ensureTestUser(t, "bulk.admin@grahamsummitllc.com")
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   "bulk.admin@grahamsummitllc.com",
+		"roles": []string{models.RoleAdmin},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"org":   orgID,
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	send := func(path string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("DELETE", path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var dryRun struct {
+		Count             int64  `json:"count"`
+		ConfirmationToken string `json:"confirmation_token"`
+	}
+	json.Unmarshal(send("/bulkdeletecustomers?email=*@bulk-swap.example", nil).Body.Bytes(), &dryRun)
+	assert.Equal(t, int64(1), dryRun.Count)
+
+	// Same count, different customer.
+	database.DB.Db.Unscoped().Where("email = ?", "old@bulk-swap.example").Delete(&models.Customer{})
+	database.DB.Db.Create(&models.Customer{OrganizationID: orgID, Name: "New", Email: "new@bulk-swap.example"})
+
+	rr := send("/bulkdeletecustomers", map[string]string{"confirmation_token": dryRun.ConfirmationToken})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	var count int64
+	database.DB.Db.Model(&models.Customer{}).Where("email = ?", "new@bulk-swap.example").Count(&count)
+	assert.Equal(t, int64(1), count)
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/redaction"
+	"gorm.io/gorm"
+)
+
+// Filter grammar shared by /listcustomers and the bulk endpoints:
+//
+//	name=Graham*        text fields accept * as a wildcard (case-insensitive)
+//	email=*@example.com
+//	address=*Summit*
+//	number=1111         exact match
+//	created_after=2024-01-01T00:00:00Z
+//	created_before=2024-12-31T00:00:00Z
+type customerFilter struct {
+	Name          string     `json:"name,omitempty"`
+	Email         string     `json:"email,omitempty"`
+	Address       string     `json:"address,omitempty"`
+	Number        *int       `json:"number,omitempty"`
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+}
+
+// parseCustomerFilter reads the filter from query. Filters on fields policy
+// redacts are refused: matching on them would reveal the hidden values one
+// guess at a time.
+func parseCustomerFilter(query url.Values, policy redaction.Policy) (customerFilter, error) {
+	for field := range policy {
+		if query.Get(field) != "" {
+			return customerFilter{}, fmt.Errorf("cannot filter on %s", field)
+		}
+	}
+
+	filter := customerFilter{
+		Name:    query.Get("name"),
+		Email:   query.Get("email"),
+		Address: query.Get("address"),
+	}
+
+	if numberStr := query.Get("number"); numberStr != "" {
+		n, err := strconv.Atoi(numberStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid number filter: %q", numberStr)
+		}
+		filter.Number = &n
+	}
+	if after := query.Get("created_after"); after != "" {
+		t, err := time.Parse(time.RFC3339, after)
+		if err != nil {
+			return filter, fmt.Errorf("invalid created_after filter: %q", after)
+		}
+		filter.CreatedAfter = &t
+	}
+	if before := query.Get("created_before"); before != "" {
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			return filter, fmt.Errorf("invalid created_before filter: %q", before)
+		}
+		filter.CreatedBefore = &t
+	}
+
+	return filter, nil
+}
+
+func (f customerFilter) IsEmpty() bool {
+	return f.Name == "" && f.Email == "" && f.Address == "" &&
+		f.Number == nil && f.CreatedAfter == nil && f.CreatedBefore == nil
+}
+
+// Apply narrows a customers query to the rows matched by the filter.
+func (f customerFilter) Apply(db *gorm.DB) *gorm.DB {
+	if f.Name != "" {
+		db = db.Where("name ILIKE ?", wildcardPattern(f.Name))
+	}
+	if f.Email != "" {
+		db = db.Where("email ILIKE ?", wildcardPattern(f.Email))
+	}
+	if f.Address != "" {
+		db = db.Where("address ILIKE ?", wildcardPattern(f.Address))
+	}
+	if f.Number != nil {
+		db = db.Where("number = ?", *f.Number)
+	}
+	if f.CreatedAfter != nil {
+		db = db.Where("created_at > ?", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		db = db.Where("created_at < ?", *f.CreatedBefore)
+	}
+	return db
+}
+
+// CacheKey returns a stable encoding of the filter for use in cache keys.
+// An empty filter encodes to "" so unfiltered list keys keep their old shape.
+// Values are escaped, so one filter can't spell out another's key.
+func (f customerFilter) CacheKey() string {
+	values := url.Values{}
+	if f.Name != "" {
+		values.Set("name", f.Name)
+	}
+	if f.Email != "" {
+		values.Set("email", f.Email)
+	}
+	if f.Address != "" {
+		values.Set("address", f.Address)
+	}
+	if f.Number != nil {
+		values.Set("number", strconv.Itoa(*f.Number))
+	}
+	if f.CreatedAfter != nil {
+		values.Set("created_after", f.CreatedAfter.UTC().Format(time.RFC3339))
+	}
+	if f.CreatedBefore != nil {
+		values.Set("created_before", f.CreatedBefore.UTC().Format(time.RFC3339))
+	}
+	return values.Encode()
+}
+
+// wildcardPattern turns a user supplied * pattern into a LIKE pattern,
+// escaping any LIKE metacharacters the user typed literally.
+func wildcardPattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return strings.ReplaceAll(s, "*", "%")
+}
@@ -5,17 +5,24 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
-	"os"
+	netmail "net/mail"
 	"strconv"
 	"time"
 
 	"github.com/capgainschristian/go_api_ds/cache"
 	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/lockout"
+	"github.com/capgainschristian/go_api_ds/metrics"
+	"github.com/capgainschristian/go_api_ds/mfa"
+	"github.com/capgainschristian/go_api_ds/middleware"
 	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/redaction"
+	"github.com/capgainschristian/go_api_ds/sessions"
 	"github.com/go-redis/redis/v8"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
@@ -26,26 +33,43 @@ func HealthCheck(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "API is up and running.")
 }
 
+// credentials is the body of SignUp and Login. Requests are decoded into
+// their own types rather than models.User, so clients can't set fields such
+// as the role.
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
 func SignUp(w http.ResponseWriter, r *http.Request) {
-	newUser := new(models.User)
+	req := new(credentials)
 
-	err := json.NewDecoder(r.Body).Decode(&newUser)
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	newUser := &models.User{Email: req.Email, Password: req.Password}
+
 	if newUser.Email == "" {
 		http.Error(w, "Missing user email", http.StatusBadRequest)
 		return
 	}
 
+	// Reject anything that isn't a bare address, such as a trailing comma or
+	// a display name.
+	if addr, err := netmail.ParseAddress(newUser.Email); err != nil || addr.Address != newUser.Email {
+		http.Error(w, "Invalid user email", http.StatusBadRequest)
+		return
+	}
+
 	if newUser.Password == "" {
 		http.Error(w, "Missing user password", http.StatusBadRequest)
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(newUser.Password), 10)
+	hash, err := hashPassword(newUser.Password)
 	if err != nil {
 		http.Error(w, "Failed to hash the password", http.StatusInternalServerError)
 		return
@@ -54,18 +78,36 @@ func SignUp(w http.ResponseWriter, r *http.Request) {
 	// Need to convert byte to string to pass to DB
 	newUser.Password = string(hash)
 
+	// Roles are granted by an admin, never chosen at signup.
+	newUser.Role = models.RoleViewer
+
 	err = database.DB.Db.Create(&newUser).Error
 	if err != nil {
 		http.Error(w, "Failed to add user to the database", http.StatusInternalServerError)
 		return
 	}
 
+	// The address may have belonged to a deleted user.
+	if err := sessions.Forget(r.Context(), cache.RedisClient.Client, newUser.Email); err != nil {
+		slog.ErrorContext(r.Context(), "Redis DEL error", "error", err)
+	}
+
+	// The user can't log in until they follow the link; if sending fails they
+	// can ask for another one.
+	if err := sendVerification(r.Context(), newUser); err != nil {
+		slog.ErrorContext(r.Context(), "Verification email failed", "user_id", newUser.ID, "error", err)
+	}
+
 	w.WriteHeader(http.StatusAccepted)
 	w.Write([]byte("User added successfully."))
 }
 
+// dummyHash is compared against when the email is unknown, so a login for a
+// missing account costs the same bcrypt time as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), 10)
+
 func Login(w http.ResponseWriter, r *http.Request) {
-	authReq := new(models.User)
+	authReq := new(credentials)
 
 	err := json.NewDecoder(r.Body).Decode(&authReq)
 	if err != nil {
@@ -73,58 +115,128 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := new(models.User)
-
 	if authReq.Email == "" {
 		http.Error(w, "Need user email to query the database", http.StatusBadRequest)
 		return
-	} else {
-		err = database.DB.Db.Unscoped().Where("email = ?", authReq.Email).First(&user).Error
+	}
+
+	ctx := r.Context()
+	ip := clientIP(r)
+
+	// The attempt is counted as failed up front, and given back if it
+	// succeeds.
+	wait, err := lockout.Reserve(ctx, cache.RedisClient.Client, authReq.Email, ip)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Redis lockout check error", "error", err)
+		http.Error(w, "Failed to check login attempts", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user := new(models.User)
+	found := true
+
+	err = database.DB.Db.Unscoped().Where("email = ?", authReq.Email).First(&user).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		found = false
+	}
+
+	hash := []byte(user.Password)
+	if !found {
+		hash = dummyHash
+	}
+
+	// Unknown emails and wrong passwords get the same response, after the
+	// same amount of work, so neither reveals which accounts exist.
+	err = comparePassword(hash, authReq.Password)
+	if err != nil || !found {
+		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		return
+	}
+
+	if err := lockout.Succeed(ctx, cache.RedisClient.Client, authReq.Email, ip); err != nil {
+		slog.ErrorContext(r.Context(), "Redis lockout error", "error", err)
+	}
+
+	if user.EmailVerifiedAt == nil {
+		http.Error(w, "Email address has not been verified; follow the link sent at signup or request a new one", http.StatusForbidden)
+		return
+	}
+
+	if user.DisabledAt != nil {
+		http.Error(w, errUserDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	loginUser(w, r, user, false)
+}
+
+// loginUser continues a login once user has proven who they are, with a
+// password or through single sign-on. With 2FA on, that only earns a
+// challenge token, which is exchanged for a session at /login/mfa together
+// with a code; withMFA skips that when the first step already used a second
+// factor.
+func loginUser(w http.ResponseWriter, r *http.Request, user *models.User, withMFA bool) {
+	if user.TOTPEnabledAt != nil && !withMFA {
+		challenge, expiresAt, err := mfa.IssueChallenge(user.Email)
 		if err != nil {
-			if errors.Is(err, gorm.ErrRecordNotFound) {
-				http.Error(w, "Customer not found", http.StatusNotFound)
-				return
-			} else {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+			http.Error(w, "Unable to encrypt and create token", http.StatusInternalServerError)
+			return
 		}
+		writeJSON(w, mfaChallengeResponse{MFARequired: true, MFAToken: challenge, ExpiresAt: expiresAt.UTC()})
+		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(authReq.Password))
+	completeLogin(w, r, user, withMFA)
+}
+
+// completeLogin starts a session for user, who has passed every
+// authentication step.
+func completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, withMFA bool) {
+	orgID, err := activeOrganization(database.DB.Db, user.ID, 0)
 	if err != nil {
-		http.Error(w, "Incorrect password", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.Email,
-		"exp": time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days expiration
-	})
-
-	// Sign and get the complete encoded token as a string using the secret
-	tokenString, err := token.SignedString([]byte(os.Getenv("BCRYPT_KEY")))
+	session, err := issueSession(database.DB.Db, w, user, "", withMFA, orgID)
 	if err != nil {
 		http.Error(w, "Unable to encrypt and create token", http.StatusInternalServerError)
 		return
 	}
 
-	// Set the token as a cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    tokenString,
-		Path:     "/",
-		Expires:  time.Now().Add(time.Hour * 24 * 30),
-		HttpOnly: true,
-		Secure:   false,
-	})
+	// Non-browser clients ask for the tokens in the body so they can send the
+	// access token as a bearer token instead of keeping a cookie jar.
+	if wantsJSON(r) {
+		writeJSON(w, session)
+		return
+	}
 
 	w.Write([]byte("Authentication was successful."))
 	w.WriteHeader(http.StatusOK)
 }
 
+// clientIP is the address the request came from. X-Forwarded-For is not
+// trusted, since any client can set it.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func ListCustomers(w http.ResponseWriter, r *http.Request) {
 	// Pagination: listcustomers?limit=10&offset=0
+	// Filtering: listcustomers?email=*@example.com (see filter.go)
 	customers := []models.Customer{}
 
 	query := r.URL.Query()
@@ -146,13 +258,22 @@ func ListCustomers(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	filter, err := parseCustomerFilter(query, redaction.ForRoles(middleware.Roles(r)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	orgID := middleware.OrganizationID(r)
+
 	// Check Redis first
 	ctx := context.Background()
-	cacheKey := "customers:limit=" + strconv.Itoa(limit) + ":offset=" + strconv.Itoa(offset)
+	cacheKey := customerListCacheKey(orgID, limit, offset, filter)
 	cachedCustomers, err := cache.RedisClient.Client.Get(ctx, cacheKey).Result()
 	if err == redis.Nil {
-		log.Println("Cache miss. Retrieved from the database.")
-		result := database.DB.Db.Unscoped().Limit(limit).Offset(offset).Find(&customers)
+		slog.DebugContext(r.Context(), "Customer list cache miss")
+		metrics.CustomerCache.WithLabelValues("miss").Inc()
+		result := filter.Apply(customersIn(database.DB.Db.Unscoped(), r)).Limit(limit).Offset(offset).Find(&customers)
 		if result.Error != nil && !errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			http.Error(w, result.Error.Error(), http.StatusInternalServerError)
 			return
@@ -168,23 +289,38 @@ func ListCustomers(w http.ResponseWriter, r *http.Request) {
 		if len(customers) > 0 {
 			err = cache.RedisClient.Client.Set(ctx, cacheKey, jsonResponse, 10*time.Minute).Err()
 			if err != nil {
-				log.Printf("Redis SET error: %v", err)
+				slog.ErrorContext(r.Context(), "Redis SET error", "error", err)
 				http.Error(w, "Failed to cache customers list", http.StatusInternalServerError)
 				return
 			}
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write(jsonResponse)
+		writeCustomers(w, r, jsonResponse)
 	} else if err != nil {
-		log.Printf("Redis GET error: %v", err)
+		slog.ErrorContext(r.Context(), "Redis GET error", "error", err)
+		metrics.CustomerCache.WithLabelValues("error").Inc()
 		http.Error(w, "Failed to retrieve customers from cache", http.StatusInternalServerError)
 	} else {
-		log.Println("Retrieved from the cache.")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(cachedCustomers))
+		slog.DebugContext(r.Context(), "Customer list cache hit")
+		metrics.CustomerCache.WithLabelValues("hit").Inc()
+		writeCustomers(w, r, []byte(cachedCustomers))
+	}
+
+}
+
+// writeCustomers sends a JSON array of customers, redacted for the
+// request's roles. The cache holds the full list, shared by every role, so
+// redaction has to happen here, on the way out, for cached and fresh lists
+// alike.
+func writeCustomers(w http.ResponseWriter, r *http.Request, customers []byte) {
+	redacted, err := redaction.ForRoles(middleware.Roles(r)).Customers(customers)
+	if err != nil {
+		http.Error(w, "Failed to redact customers", http.StatusInternalServerError)
+		return
 	}
 
+	w.WriteHeader(http.StatusOK)
+	w.Write(redacted)
 }
 
 func AddCustomer(w http.ResponseWriter, r *http.Request) {
@@ -199,7 +335,16 @@ func AddCustomer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing customer email", http.StatusBadRequest)
 		return
 	}
-	err = database.DB.Db.Create(&customer).Error
+	orgID := middleware.OrganizationID(r)
+	customer.OrganizationID = orgID
+	customer.CreatedBy = middleware.Subject(r)
+	customer.UpdatedBy = customer.CreatedBy
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&customer).Error; err != nil {
+			return err
+		}
+		return recordCustomerChange(tx, middleware.Subject(r), historyCreate, nil, customer)
+	})
 	if err != nil {
 		http.Error(w, "Failed to add customer to the database", http.StatusInternalServerError)
 		return
@@ -211,18 +356,19 @@ func AddCustomer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Every cached page and filtered list may now be missing the customer.
 	ctx := context.Background()
-	err = cache.RedisClient.Client.Set(ctx, "customer:"+customer.Email, customerJSON, 10*time.Minute).Err()
+	err = invalidateCustomerCache(ctx, orgID, []string{customer.Email})
 	if err != nil {
-		log.Printf("Redis SET error: %v", err)
-		http.Error(w, "Failed to add customer to the cache", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Redis DEL error", "error", err)
+		http.Error(w, "Failed to invalidate cache", http.StatusInternalServerError)
 		return
 	}
 
-	err = cache.RedisClient.Client.Del(ctx, "customers:limit=10:offset=0").Err()
+	err = cache.RedisClient.Client.Set(ctx, customerCacheKey(orgID, customer.Email), customerJSON, 10*time.Minute).Err()
 	if err != nil {
-		log.Printf("Redis DEL error: %v", err)
-		http.Error(w, "Failed to invalidate cache", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Redis SET error", "error", err)
+		http.Error(w, "Failed to add customer to the cache", http.StatusInternalServerError)
 		return
 	}
 
@@ -243,7 +389,7 @@ func DeleteCustomer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing customer email", http.StatusBadRequest)
 		return
 	} else {
-		err = database.DB.Db.Unscoped().Where("email = ?", customer.Email).First(&customer).Error
+		err = customersIn(database.DB.Db.Unscoped(), r).Where("email = ?", customer.Email).First(&customer).Error
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
 				http.Error(w, "Customer not found", http.StatusNotFound)
@@ -255,26 +401,24 @@ func DeleteCustomer(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = database.DB.Db.Unscoped().Delete(&customer).Error
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := recordCustomerChange(tx, middleware.Subject(r), historyDelete, customer, nil); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&customer).Error
+	})
 	if err != nil {
 		http.Error(w, "Failed to delete customer from database", http.StatusInternalServerError)
 		return
 	}
 
 	ctx := context.Background()
-	err = cache.RedisClient.Client.Del(ctx, "customer:"+customer.Email).Err()
+	err = invalidateCustomerCache(ctx, customer.OrganizationID, []string{customer.Email})
 	if err != nil {
-		log.Printf("Redis DEL error: %v", err)
+		slog.ErrorContext(r.Context(), "Redis DEL error", "error", err)
 		http.Error(w, "Failed to delete the customer from the cache", http.StatusInternalServerError)
 		return
 	}
-	// This is using cacheKey from ListCustomers but in strict string format.
-	err = cache.RedisClient.Client.Del(ctx, "customers:limit=10:offset=0").Err()
-	if err != nil {
-		log.Printf("Redis DEL error: %v", err)
-		http.Error(w, "Failed to invalidate cache", http.StatusInternalServerError)
-		return
-	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Customer deleted successfully."))
@@ -300,7 +444,7 @@ func UpdateCustomer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = database.DB.Db.Where("email = ?", updatedinfo.Email).First(&customer).Error
+	err = customersIn(database.DB.Db, r).Where("email = ?", updatedinfo.Email).First(&customer).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			http.Error(w, "Customer not found", http.StatusNotFound)
@@ -311,6 +455,8 @@ func UpdateCustomer(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	before := *customer
+
 	// Checking for empty fields to allow updating individual field without resetting the others
 	if updatedinfo.Name != "" {
 		customer.Name = updatedinfo.Name
@@ -321,8 +467,14 @@ func UpdateCustomer(w http.ResponseWriter, r *http.Request) {
 	if updatedinfo.Number != 0 {
 		customer.Number = updatedinfo.Number
 	}
+	customer.UpdatedBy = middleware.Subject(r)
 
-	err = database.DB.Db.Save(&customer).Error
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&customer).Error; err != nil {
+			return err
+		}
+		return recordCustomerChange(tx, middleware.Subject(r), historyUpdate, &before, customer)
+	})
 	if err != nil {
 		http.Error(w, "Failed to update customer in database", http.StatusInternalServerError)
 		return
@@ -336,17 +488,17 @@ func UpdateCustomer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := context.Background()
-	err = cache.RedisClient.Client.Set(ctx, "customer:"+customer.Email, customerJSON, 10*time.Minute).Err()
+	err = invalidateCustomerCache(ctx, customer.OrganizationID, []string{customer.Email})
 	if err != nil {
-		log.Printf("Redis SET error: %v", err)
-		http.Error(w, "Failed to update customer to the cache", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Redis DEL error", "error", err)
+		http.Error(w, "Failed to invalidate cache", http.StatusInternalServerError)
 		return
 	}
-	// This is using cacheKey from ListCustomers but in strict string format.
-	err = cache.RedisClient.Client.Del(ctx, "customers:limit=10:offset=0").Err()
+
+	err = cache.RedisClient.Client.Set(ctx, customerCacheKey(customer.OrganizationID, customer.Email), customerJSON, 10*time.Minute).Err()
 	if err != nil {
-		log.Printf("Redis DEL error: %v", err)
-		http.Error(w, "Failed to invalidate cache", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Redis SET error", "error", err)
+		http.Error(w, "Failed to update customer to the cache", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -5,26 +5,87 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/capgainschristian/go_api_ds/cache"
 	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/handlers"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/middleware"
 	"github.com/capgainschristian/go_api_ds/models"
 	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/capgainschristian/go_api_ds/sessions"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
 
+// testCSRF is the csrf claim of tokens minted by tests for cookie sessions,
+// sent back in middleware.CSRFHeader.
+const testCSRF = "test-csrf-token"
+
+// testOrganization returns the organization tests act in, creating it the
+// first time.
+func testOrganization(t *testing.T) uint {
+	t.Helper()
+
+	org := models.Organization{Name: "Test organization"}
+	if err := database.DB.Db.Where(&org).FirstOrCreate(&org).Error; err != nil {
+		t.Fatal("Failed to create organization:", err)
+	}
+	return org.ID
+}
+
+// joinTestOrganization makes the user with email a member of the test
+// organization, so their logins act in it.
+func joinTestOrganization(t *testing.T, email string) {
+	t.Helper()
+
+	user := new(models.User)
+	if err := database.DB.Db.Where("email = ?", email).First(&user).Error; err != nil {
+		t.Fatal("Failed to find user:", err)
+	}
+	database.DB.Db.Where(&models.OrganizationMember{UserID: user.ID}).Delete(&models.OrganizationMember{})
+	err := database.DB.Db.Create(&models.OrganizationMember{OrganizationID: testOrganization(t), UserID: user.ID}).Error
+	if err != nil {
+		t.Fatal("Failed to join organization:", err)
+	}
+}
+
+// ensureTestUser makes sure a user with email exists, since tokens naming a
+// subject no user has are refused.
+func ensureTestUser(t *testing.T, email string) {
+	t.Helper()
+
+	user := models.User{Email: email, Password: "unused", Role: models.RoleViewer}
+	if err := database.DB.Db.Where("email = ?", email).FirstOrCreate(&user).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+	// Drop any generation cached while the user didn't exist.
+	sessions.Forget(context.Background(), cache.RedisClient.Client, email)
+}
+
 func TestMain(m *testing.M) {
 
 	database.ConnectDb()
 
 	cache.ConnectRedis()
 
+	if err := keys.LoadDefault(); err != nil {
+		slog.Error("Failed to load JWT keys", "error", err)
+		os.Exit(2)
+	}
+
+	// The tests log in far more often than the rate limits allow from a
+	// single address; TestRateLimit turns them back on.
+	os.Setenv("RATE_LIMIT_AUTH", "0")
+	os.Setenv("RATE_LIMIT_API", "0")
+
 	code := m.Run()
 
 	os.Exit(code)
@@ -40,9 +101,9 @@ func TestSignUp(t *testing.T) {
 		t.Fatal("Failed to delete from customers:", result.Error)
 	}
 
-	user := &models.User{
-		Email:    "admin@grahamsummitllc.com",
-		Password: "thisissecured",
+	user := map[string]string{
+		"email":    "admin@grahamsummitllc.com",
+		"password": "thisissecured",
 	}
 
 	jsonUser, _ := json.Marshal(user)
@@ -63,7 +124,7 @@ func TestSignUp(t *testing.T) {
 	assert.Equal(t, expected, rr.Body.String())
 
 	var count int64
-	database.DB.Db.Model(models.User{}).Where("email = ?", user.Email).Count(&count)
+	database.DB.Db.Model(models.User{}).Where("email = ?", user["email"]).Count(&count)
 	assert.Equal(t, int64(1), count)
 }
 
@@ -77,9 +138,12 @@ func TestLogin(t *testing.T) {
 		t.Fatal("User does not exist:", result.Error)
 	}
 
-	user := &models.User{
-		Email:    "admin@grahamsummitllc.com",
-		Password: "thisissecured",
+	// TestSignUp's user hasn't followed the verification link.
+	database.DB.Db.Model(&models.User{}).Where("email = ?", "admin@grahamsummitllc.com").Update("email_verified_at", time.Now())
+
+	user := map[string]string{
+		"email":    "admin@grahamsummitllc.com",
+		"password": "thisissecured",
 	}
 
 	jsonUser, _ := json.Marshal(user)
@@ -101,6 +165,52 @@ func TestLogin(t *testing.T) {
 
 }
 
+func TestLoginReturnsBearerToken(t *testing.T) {
+	user := map[string]string{
+		"email":    "admin@grahamsummitllc.com",
+		"password": "thisissecured",
+	}
+
+	jsonUser, _ := json.Marshal(user)
+	joinTestOrganization(t, user["email"])
+
+	router := routes.SetupRouter()
+
+	req, err := http.NewRequest("POST", "/login", bytes.NewBuffer(jsonUser))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.NotEmpty(t, body.AccessToken)
+	assert.Equal(t, "Bearer", body.TokenType)
+	assert.Greater(t, body.ExpiresIn, int64(0))
+
+	// Browsers still get the cookie.
+	assert.NotEmpty(t, rr.Result().Cookies())
+
+	// The token works as a bearer token.
+	req, _ = http.NewRequest("GET", "/customers/1/history", nil)
+	req.Header.Set("Authorization", "Bearer "+body.AccessToken)
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
 func TestAddCustomer(t *testing.T) {
 	if database.DB.Db == nil {
 		t.Fatal("Database is not initialized")
@@ -133,12 +243,13 @@ func TestAddCustomer(t *testing.T) {
 
 	router := routes.SetupRouter()
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.Email,
-		"exp": time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days expiration
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   user.Email,
+		"roles": []string{models.RoleEditor},
+		"exp":   time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days expiration
+		"csrf":  testCSRF,
+		"org":   testOrganization(t),
 	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("BCRYPT_KEY")))
 	if err != nil {
 		t.Fatal("Failed to sign token:", err)
 	}
@@ -156,6 +267,7 @@ func TestAddCustomer(t *testing.T) {
 		HttpOnly: true,
 		Secure:   false,
 	})
+	req.Header.Set(middleware.CSRFHeader, testCSRF)
 
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -169,6 +281,11 @@ func TestAddCustomer(t *testing.T) {
 	database.DB.Db.Model(models.Customer{}).Where("email = ?", customer.Email).Count(&count)
 	assert.Equal(t, int64(1), count)
 
+	var stored models.Customer
+	database.DB.Db.Where("email = ?", customer.Email).First(&stored)
+	assert.Equal(t, user.Email, stored.CreatedBy)
+	assert.Equal(t, user.Email, stored.UpdatedBy)
+
 	ctx := context.Background()
 	cacheKey := "customer:" + customer.Email
 	customerJSON, err := json.Marshal(customer)
@@ -209,12 +326,13 @@ func TestUpdateCustomer(t *testing.T) {
 
 	router := routes.SetupRouter()
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.Email,
-		"exp": time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days expiration
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   user.Email,
+		"roles": []string{models.RoleEditor},
+		"exp":   time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days expiration
+		"csrf":  testCSRF,
+		"org":   testOrganization(t),
 	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("BCRYPT_KEY")))
 	if err != nil {
 		t.Fatal("Failed to sign token:", err)
 	}
@@ -233,6 +351,7 @@ func TestUpdateCustomer(t *testing.T) {
 		HttpOnly: true,
 		Secure:   false,
 	})
+	req.Header.Set(middleware.CSRFHeader, testCSRF)
 
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -248,6 +367,35 @@ func TestUpdateCustomer(t *testing.T) {
 	assert.Equal(t, updatedCustomer.Name, customer.Name)
 	assert.Equal(t, updatedCustomer.Address, customer.Address)
 	assert.Equal(t, updatedCustomer.Number, customer.Number)
+	assert.Equal(t, user.Email, customer.UpdatedBy)
+}
+
+func TestAddCustomerRecordsPrincipal(t *testing.T) {
+	email := "principal.customer@grahamsummitllc.com"
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+	defer database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+
+	// The body cannot claim someone else wrote the customer.
+	body, _ := json.Marshal(models.Customer{Name: "Principal", Email: email, Address: "1 Context Way", CreatedBy: "someone@else.com"})
+
+	req := httptest.NewRequest("POST", "/addcustomer", bytes.NewBuffer(body))
+	req = req.WithContext(middleware.WithPrincipal(req.Context(), &middleware.Principal{
+		UserID:         42,
+		Email:          "injected@grahamsummitllc.com",
+		Roles:          []string{models.RoleEditor},
+		AuthMethod:     middleware.AuthMethodBearer,
+		OrganizationID: testOrganization(t),
+	}))
+
+	rr := httptest.NewRecorder()
+	handlers.AddCustomer(rr, req)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var stored models.Customer
+	err := database.DB.Db.Where("email = ?", email).First(&stored).Error
+	assert.NoError(t, err)
+	assert.Equal(t, "injected@grahamsummitllc.com", stored.CreatedBy)
+	assert.Equal(t, "injected@grahamsummitllc.com", stored.UpdatedBy)
 }
 
 func TestDeleteCustomer(t *testing.T) {
@@ -271,12 +419,13 @@ func TestDeleteCustomer(t *testing.T) {
 
 	router := routes.SetupRouter()
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": user.Email,
-		"exp": time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days expiration
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   user.Email,
+		"roles": []string{models.RoleEditor},
+		"exp":   time.Now().Add(time.Hour * 24 * 30).Unix(), // 30 days expiration
+		"csrf":  testCSRF,
+		"org":   testOrganization(t),
 	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("BCRYPT_KEY")))
 	if err != nil {
 		t.Fatal("Failed to sign token:", err)
 	}
@@ -294,6 +443,7 @@ func TestDeleteCustomer(t *testing.T) {
 		HttpOnly: true,
 		Secure:   false,
 	})
+	req.Header.Set(middleware.CSRFHeader, testCSRF)
 
 	rr := httptest.NewRecorder()
 	router.ServeHTTP(rr, req)
@@ -307,3 +457,144 @@ func TestDeleteCustomer(t *testing.T) {
 	database.DB.Db.Model(&models.Customer{}).Where("email = ?", customer.Email).Count(&count)
 	assert.Equal(t, int64(0), count)
 }
+
+func TestListCustomersRedactsForViewers(t *testing.T) {
+	email := "redacted@grahamsummitllc.com"
+	orgID := testOrganization(t)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+	defer database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+	database.DB.Db.Create(&models.Customer{OrganizationID: orgID, Name: "Redacted", Email: email, Address: "1 Private Road", Number: 123456})
+
+	router := routes.SetupRouter()
+
+	list := func(role, query string) (int, string) {
+		ensureTestUser(t, role+"@grahamsummitllc.com")
+		tokenString, err := keys.Default().Sign(jwt.MapClaims{
+			"sub":   role + "@grahamsummitllc.com",
+			"roles": []string{role},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"org":   orgID,
+		})
+		if err != nil {
+			t.Fatal("Failed to sign token:", err)
+		}
+
+		req, _ := http.NewRequest("GET", "/listcustomers?email="+email+query, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code, rr.Body.String()
+	}
+
+	// The editor's request fills the cache; the viewer's must not be
+	// served from it as is.
+	code, editor := list(models.RoleEditor, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, editor, "1 Private Road")
+	code, viewer := list(models.RoleViewer, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, viewer, "1 Private Road")
+	assert.NotContains(t, viewer, "123456")
+	assert.Contains(t, viewer, `"number":"****56"`)
+
+	// Nor can a viewer find the hidden values by filtering on them.
+	code, _ = list(models.RoleViewer, "&address=1*")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = list(models.RoleViewer, "&number=123456")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, editor = list(models.RoleEditor, "&number=123456")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, editor, "1 Private Road")
+}
+
+func TestWritesInvalidateEveryCachedList(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	email := "stale.lists@grahamsummitllc.com"
+	orgID := testOrganization(t)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+	defer database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+
+	ensureTestUser(t, "editor@grahamsummitllc.com")
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   "editor@grahamsummitllc.com",
+		"roles": []string{models.RoleEditor},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"org":   orgID,
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	names := func() []string {
+		var customers []models.Customer
+		json.Unmarshal(send("GET", "/listcustomers?limit=5&email="+email, nil).Body.Bytes(), &customers)
+		var out []string
+		for _, c := range customers {
+			out = append(out, c.Name)
+		}
+		return out
+	}
+
+	assert.Equal(t, http.StatusAccepted, send("POST", "/addcustomer", models.Customer{Name: "Before", Email: email}).Code)
+	assert.Equal(t, []string{"Before"}, names())
+
+	assert.Equal(t, http.StatusOK, send("PUT", "/updatecustomer", models.Customer{Name: "After", Email: email}).Code)
+	assert.Equal(t, []string{"After"}, names())
+
+	assert.Equal(t, http.StatusOK, send("DELETE", "/deletecustomer", models.Customer{Email: email}).Code)
+	assert.Empty(t, names())
+}
+
+func TestFiltersDoNotShareCachedLists(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	email := "cache.collision@grahamsummitllc.com"
+	orgID := testOrganization(t)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+	defer database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+	database.DB.Db.Create(&models.Customer{OrganizationID: orgID, Name: "Collision", Email: email, Number: 4242})
+
+	ensureTestUser(t, "editor@grahamsummitllc.com")
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   "editor@grahamsummitllc.com",
+		"roles": []string{models.RoleEditor},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"org":   orgID,
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	list := func(query string) string {
+		req, _ := http.NewRequest("GET", "/listcustomers?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+
+	assert.Contains(t, list("name=Collision&number=4242"), email)
+	// A name that spells out the first filter is a different filter.
+	assert.NotContains(t, list("name="+url.QueryEscape("Collision&number=4242")), email)
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/outbox"
+	"github.com/capgainschristian/go_api_ds/redaction"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	historyCreate = "create"
+	historyUpdate = "update"
+	historyDelete = "delete"
+)
+
+var historyEvents = map[string]string{
+	historyCreate: outbox.CustomerCreated,
+	historyUpdate: outbox.CustomerUpdated,
+	historyDelete: outbox.CustomerDeleted,
+}
+
+// Bookkeeping fields that change on every write and would only add noise to
+// the diff.
+var historyIgnoredFields = map[string]bool{
+	"ID":        true,
+	"CreatedAt": true,
+	"UpdatedAt": true,
+	"DeletedAt": true,
+	"CreatedBy": true,
+	"UpdatedBy": true,
+}
+
+type fieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// recordCustomerChange writes an audit row and an outbox event for a customer
+// write. It must be called with the transaction doing the write so all of
+// them commit or none do. before is nil for creates and after is nil for
+// deletes.
+func recordCustomerChange(tx *gorm.DB, actor, operation string, before, after *models.Customer) error {
+	entry := models.CustomerHistory{
+		Actor:     actor,
+		Operation: operation,
+	}
+
+	beforeFields := map[string]interface{}{}
+	afterFields := map[string]interface{}{}
+
+	if before != nil {
+		entry.CustomerID = before.ID
+		entry.OrganizationID = before.OrganizationID
+		b, err := json.Marshal(before)
+		if err != nil {
+			return err
+		}
+		entry.Before = b
+		if err := json.Unmarshal(b, &beforeFields); err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		entry.CustomerID = after.ID
+		entry.OrganizationID = after.OrganizationID
+		a, err := json.Marshal(after)
+		if err != nil {
+			return err
+		}
+		entry.After = a
+		if err := json.Unmarshal(a, &afterFields); err != nil {
+			return err
+		}
+	}
+
+	diff := map[string]fieldChange{}
+	for field, value := range afterFields {
+		if historyIgnoredFields[field] {
+			continue
+		}
+		if old, ok := beforeFields[field]; !ok || !reflect.DeepEqual(old, value) {
+			diff[field] = fieldChange{Before: beforeFields[field], After: value}
+		}
+	}
+	for field, old := range beforeFields {
+		if _, ok := afterFields[field]; !ok && !historyIgnoredFields[field] {
+			diff[field] = fieldChange{Before: old, After: nil}
+		}
+	}
+
+	d, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	entry.Diff = d
+
+	if err := tx.Create(&entry).Error; err != nil {
+		return err
+	}
+
+	// Publish the change to downstream services through the outbox.
+	data := entry.After
+	if after == nil {
+		data = entry.Before
+	}
+	return outbox.Add(tx, historyEvents[operation], entry.OrganizationID, entry.CustomerID, actor, data, d)
+}
+
+// CustomerHistory lists the audit trail of a customer, newest first:
+// GET /customers/{id}/history?limit=10&offset=0&actor=...&since=...&until=...
+func CustomerHistory(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid customer id", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+
+	// Provide defaults so no input required
+	limit := 10
+	offset := 0
+
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil {
+		limit = l
+	}
+	if o, err := strconv.Atoi(query.Get("offset")); err == nil {
+		offset = o
+	}
+
+	// Scoped by organization too, since deleted customers only live on here.
+	db := database.DB.Db.Scopes(models.InOrganization(middleware.OrganizationID(r))).
+		Where("customer_id = ?", customerID)
+
+	if actor := query.Get("actor"); actor != "" {
+		db = db.Where("actor = ?", actor)
+	}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		db = db.Where("created_at >= ?", t)
+	}
+	if until := query.Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			http.Error(w, "Invalid until parameter", http.StatusBadRequest)
+			return
+		}
+		db = db.Where("created_at < ?", t)
+	}
+
+	history := []models.CustomerHistory{}
+
+	err = db.Order("created_at DESC, id DESC").Limit(limit).Offset(offset).Find(&history).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Snapshots and diffs are redacted like the customers they describe.
+	policy := redaction.ForRoles(middleware.Roles(r))
+	for i := range history {
+		if err := redactHistory(policy, &history[i]); err != nil {
+			http.Error(w, "Failed to redact customer history", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	jsonResponse, err := json.Marshal(history)
+	if err != nil {
+		http.Error(w, "Failed to serialize customer history", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
+
+func redactHistory(policy redaction.Policy, entry *models.CustomerHistory) error {
+	before, err := policy.Customer(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := policy.Customer(entry.After)
+	if err != nil {
+		return err
+	}
+	diff, err := policy.Diff(entry.Diff)
+	if err != nil {
+		return err
+	}
+
+	entry.Before, entry.After, entry.Diff = before, after, diff
+	return nil
+}
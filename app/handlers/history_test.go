@@ -0,0 +1,94 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCustomerHistory(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	actor := "historian@grahamsummitllc.com"
+	email := "history.customer@grahamsummitllc.com"
+
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+
+	ensureTestUser(t, actor)
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   actor,
+		"roles": []string{models.RoleEditor},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"csrf":  testCSRF,
+		"org":   testOrganization(t),
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+		req.Header.Set(middleware.CSRFHeader, testCSRF)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("POST", "/addcustomer", models.Customer{Name: "History", Email: email, Address: "1 Old Road", Number: 1})
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	rr = send("PUT", "/updatecustomer", models.Customer{Email: email, Address: "2 New Road"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var customer models.Customer
+	database.DB.Db.Where("email = ?", email).First(&customer)
+
+	rr = send("GET", "/customers/"+strconv.FormatUint(uint64(customer.ID), 10)+"/history?actor="+actor, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var history []struct {
+		Actor     string                            `json:"actor"`
+		Operation string                            `json:"operation"`
+		Diff      map[string]map[string]interface{} `json:"diff"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &history))
+	if assert.Len(t, history, 2) {
+		// Newest first
+		assert.Equal(t, "update", history[0].Operation)
+		assert.Equal(t, actor, history[0].Actor)
+		assert.Equal(t, "1 Old Road", history[0].Diff["address"]["before"])
+		assert.Equal(t, "2 New Road", history[0].Diff["address"]["after"])
+		assert.NotContains(t, history[0].Diff, "name")
+		assert.Equal(t, "create", history[1].Operation)
+	}
+
+	rr = send("DELETE", "/deletecustomer", models.Customer{Email: email})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var count int64
+	database.DB.Db.Model(&models.CustomerHistory{}).Where("customer_id = ? AND operation = ?", customer.ID, "delete").Count(&count)
+	assert.Equal(t, int64(1), count)
+}
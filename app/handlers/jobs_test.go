@@ -0,0 +1,60 @@
+package handlers_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/jobs"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetJobIsScopedToOrganization(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	orgID := testOrganization(t)
+	other := models.Organization{Name: "Other jobs organization"}
+	if err := database.DB.Db.Where(&other).FirstOrCreate(&other).Error; err != nil {
+		t.Fatal("Failed to create organization:", err)
+	}
+
+	job, err := jobs.Type[struct{}]{Name: "test.scoped"}.EnqueueIn(database.DB.Db, orgID, struct{}{})
+	if err != nil {
+		t.Fatal("Failed to enqueue job:", err)
+	}
+	defer database.DB.Db.Unscoped().Delete(job)
+
+	router := routes.SetupRouter()
+
+	get := func(org uint) int {
+		ensureTestUser(t, "jobs@grahamsummitllc.com")
+		tokenString, err := keys.Default().Sign(jwt.MapClaims{
+			"sub":   "jobs@grahamsummitllc.com",
+			"roles": []string{models.RoleEditor},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"org":   org,
+		})
+		if err != nil {
+			t.Fatal("Failed to sign token:", err)
+		}
+
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/jobs/%d", job.ID), nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get(orgID))
+	assert.Equal(t, http.StatusNotFound, get(other.ID))
+	assert.Equal(t, http.StatusForbidden, get(0))
+}
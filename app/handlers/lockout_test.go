@@ -0,0 +1,117 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginLockout(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+
+	email := "lockout@grahamsummitllc.com"
+	now := time.Now()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("thisissecured"), 10)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	if err := database.DB.Db.Create(&models.User{Email: email, Password: string(hash), Role: models.RoleViewer, EmailVerifiedAt: &now}).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+
+	ctx := context.Background()
+	clear := func() {
+		cache.RedisClient.Client.Del(ctx,
+			"auth:failures:account:"+email,
+			"auth:failures:account:nobody@grahamsummitllc.com",
+			"auth:failures:ip:192.0.2.1")
+	}
+	clear()
+	defer clear()
+
+	router := routes.SetupRouter()
+
+	login := func(email, password string) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(map[string]string{"email": email, "password": password})
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(jsonBody))
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Unknown users and wrong passwords are indistinguishable.
+	unknown := login("nobody@grahamsummitllc.com", "thisissecured")
+	wrong := login(email, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, unknown.Code)
+	assert.Equal(t, unknown.Code, wrong.Code)
+	assert.Equal(t, unknown.Body.String(), wrong.Body.String())
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login(email, "wrong").Code)
+	}
+
+	// The account is now locked, even for the right password.
+	rr := login(email, "thisissecured")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	// Once the lock is lifted a successful login resets the counter.
+	cache.RedisClient.Client.Del(ctx, "auth:failures:account:"+email)
+	assert.Equal(t, http.StatusOK, login(email, "thisissecured").Code)
+}
+
+func TestLoginLockoutHoldsForParallelGuesses(t *testing.T) {
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+
+	email := "parallel.lockout@grahamsummitllc.com"
+	ctx := context.Background()
+	clear := func() {
+		cache.RedisClient.Client.Del(ctx, "auth:failures:account:"+email, "auth:failures:ip:192.0.2.2")
+	}
+	clear()
+	defer clear()
+
+	router := routes.SetupRouter()
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jsonBody, _ := json.Marshal(map[string]string{"email": email, "password": "wrong"})
+			req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(jsonBody))
+			req.RemoteAddr = "192.0.2.2:1234"
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	guesses := 0
+	for code := range codes {
+		if code == http.StatusUnauthorized {
+			guesses++
+		}
+	}
+	assert.Equal(t, 3, guesses, "only LOGIN_MAX_FAILURES guesses should reach the password check")
+}
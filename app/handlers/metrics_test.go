@@ -0,0 +1,75 @@
+package handlers_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/metrics"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListCustomersMetrics(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	// A fresh email each run, so the first lookup misses the cache.
+	email := fmt.Sprintf("metrics.%d@grahamsummitllc.com", time.Now().UnixNano())
+	orgID := testOrganization(t)
+	database.DB.Db.Create(&models.Customer{OrganizationID: orgID, Name: "Measured", Email: email})
+	defer database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+
+	ensureTestUser(t, "metrics@grahamsummitllc.com")
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   "metrics@grahamsummitllc.com",
+		"roles": []string{models.RoleViewer},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"org":   orgID,
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	misses := testutil.ToFloat64(metrics.CustomerCache.WithLabelValues("miss"))
+	hits := testutil.ToFloat64(metrics.CustomerCache.WithLabelValues("hit"))
+	requests := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("GET", "/listcustomers", "200"))
+
+	assert.Equal(t, http.StatusOK, send("/listcustomers?email="+email).Code)
+	assert.Equal(t, http.StatusOK, send("/listcustomers?email="+email).Code)
+
+	assert.Equal(t, misses+1, testutil.ToFloat64(metrics.CustomerCache.WithLabelValues("miss")))
+	assert.Equal(t, hits+1, testutil.ToFloat64(metrics.CustomerCache.WithLabelValues("hit")))
+	assert.Equal(t, requests+2, testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues("GET", "/listcustomers", "200")))
+
+	// Scrapers need the token, when one is set.
+	t.Setenv("METRICS_TOKEN", "scrape-me")
+	assert.Equal(t, http.StatusUnauthorized, send("/metrics").Code)
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape-me")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `go_api_ds_http_request_duration_seconds_count{method="GET",route="/listcustomers"}`)
+	assert.Contains(t, rr.Body.String(), `go_api_ds_customer_cache_lookups_total{result="hit"}`)
+}
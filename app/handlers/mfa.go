@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/lockout"
+	"github.com/capgainschristian/go_api_ds/mfa"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"gorm.io/gorm"
+)
+
+type mfaChallengeResponse struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// secondFactor is either a TOTP code or a recovery code.
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// LoginMFA finishes a login started by Login for a user with 2FA on. Wrong
+// codes count towards the same lockout as wrong passwords.
+func LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		secondFactor
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	email, err := mfa.ParseChallenge(req.MFAToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	ip := clientIP(r)
+
+	// The attempt is counted as failed up front, and given back if it
+	// succeeds.
+	wait, err := lockout.Reserve(ctx, cache.RedisClient.Client, email, ip)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Redis lockout check error", "error", err)
+		http.Error(w, "Failed to check login attempts", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user := new(models.User)
+	err = database.DB.Db.Where("email = ?", email).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, mfa.ErrInvalidChallenge.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ok, err := checkSecondFactor(database.DB.Db, user, req.secondFactor)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid authentication code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := lockout.Succeed(ctx, cache.RedisClient.Client, email, ip); err != nil {
+		slog.ErrorContext(r.Context(), "Redis lockout error", "error", err)
+	}
+
+	if user.DisabledAt != nil {
+		http.Error(w, errUserDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	completeLogin(w, r, user, true)
+}
+
+// checkSecondFactor reports whether factor is a valid code for user. TOTP
+// codes can't be replayed and recovery codes only work once.
+func checkSecondFactor(db *gorm.DB, user *models.User, factor secondFactor) (bool, error) {
+	if user.TOTPEnabledAt == nil {
+		return false, nil
+	}
+
+	if factor.RecoveryCode != "" {
+		result := db.Model(&models.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, mfa.HashRecoveryCode(factor.RecoveryCode)).
+			Update("used_at", time.Now())
+		return result.RowsAffected == 1, result.Error
+	}
+
+	step, ok := mfa.Validate(user.TOTPSecret, factor.Code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	result := db.Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		Update("totp_last_step", step)
+	return result.RowsAffected == 1, result.Error
+}
+
+// EnrollTOTP starts enrollment by generating a secret for the user's
+// authenticator app. 2FA isn't enforced until ConfirmTOTP succeeds.
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	if middleware.AuthMethod(r) == middleware.AuthMethodAPIKey {
+		http.Error(w, "API keys cannot manage two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := mfa.GenerateSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	err = database.DB.Db.Model(&user).Update("totp_secret", secret).Error
+	if err != nil {
+		http.Error(w, "Failed to save secret", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]string{
+		"secret":      secret,
+		"otpauth_uri": mfa.URI(mfa.Issuer(), user.Email, secret),
+	})
+}
+
+// ConfirmTOTP turns 2FA on once the user proves their app works, and
+// returns recovery codes. They are only shown this once.
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	if middleware.AuthMethod(r) == middleware.AuthMethodAPIKey {
+		http.Error(w, "API keys cannot manage two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	var req secondFactor
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Two-factor enrollment has not been started", http.StatusBadRequest)
+		return
+	}
+
+	step, valid := mfa.Validate(user.TOTPSecret, req.Code, time.Now())
+	if !valid {
+		http.Error(w, "Invalid authentication code", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := mfa.GenerateRecoveryCodes(mfa.RecoveryCodeCount)
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"totp_enabled_at": time.Now(),
+			"totp_last_step":  step,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		for _, code := range codes {
+			err := tx.Create(&models.RecoveryCode{UserID: user.ID, CodeHash: mfa.HashRecoveryCode(code)}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTOTP turns 2FA off, given a current code or a recovery code. Users
+// whose role requires 2FA can't turn it off.
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	if middleware.AuthMethod(r) == middleware.AuthMethodAPIKey {
+		http.Error(w, "API keys cannot manage two-factor authentication", http.StatusForbidden)
+		return
+	}
+
+	var req secondFactor
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	required, err := mfa.RequiredFor(database.DB.Db, []string{user.Role})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if required {
+		http.Error(w, "Two-factor authentication is required for your role", http.StatusForbidden)
+		return
+	}
+
+	valid, err := checkSecondFactor(database.DB.Db, user, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid authentication code", http.StatusBadRequest)
+		return
+	}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Two-factor authentication disabled."))
+}
+
+// GetMFAPolicy lists the roles that must use 2FA.
+func GetMFAPolicy(w http.ResponseWriter, r *http.Request) {
+	roles, err := mfa.RequiredRoles(database.DB.Db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string][]string{"required_roles": roles})
+}
+
+// UpdateMFAPolicy replaces the roles that must use 2FA. Users in those roles
+// who haven't enrolled can still log in; their tokens are refused by
+// protected routes, but still reach the authenticated ones such as enrollment
+// and their own account.
+func UpdateMFAPolicy(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RequiredRoles []string `json:"required_roles"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, role := range req.RequiredRoles {
+		if !middleware.ValidRole(role) {
+			http.Error(w, "Invalid role: "+role, http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = mfa.SetRequiredRoles(database.DB.Db, req.RequiredRoles)
+	if err != nil {
+		http.Error(w, "Failed to update MFA policy", http.StatusInternalServerError)
+		return
+	}
+
+	GetMFAPolicy(w, r)
+}
@@ -0,0 +1,147 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/mfa"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTOTPLogin(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	email := "totp@grahamsummitllc.com"
+	now := time.Now()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("thisissecured"), 10)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	if err := database.DB.Db.Create(&models.User{Email: email, Password: string(hash), Role: models.RoleViewer, EmailVerifiedAt: &now}).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+	joinTestOrganization(t, email)
+	cache.RedisClient.Client.Del(context.Background(), "auth:failures:account:"+email)
+
+	router := routes.SetupRouter()
+
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	credentials := map[string]string{"email": email, "password": "thisissecured"}
+
+	rr := send("POST", "/login", "", credentials)
+	var pair tokenPair
+	json.Unmarshal(rr.Body.Bytes(), &pair)
+
+	rr = send("POST", "/mfa/totp/enroll", pair.AccessToken, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var enrollment struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &enrollment)
+	assert.NotEmpty(t, enrollment.Secret)
+	assert.Contains(t, enrollment.OtpauthURI, enrollment.Secret)
+
+	step := mfa.Step(time.Now())
+	code, _ := mfa.Code(enrollment.Secret, step)
+	rr = send("POST", "/mfa/totp/confirm", pair.AccessToken, map[string]string{"code": code})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &confirmation)
+	assert.Len(t, confirmation.RecoveryCodes, mfa.RecoveryCodeCount)
+
+	// The password now only earns a challenge, which isn't an access token.
+	rr = send("POST", "/login", "", credentials)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &challenge)
+	assert.True(t, challenge.MFARequired)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/customers/1/history", challenge.MFAToken, nil).Code)
+
+	// The code used to confirm can't be replayed.
+	rr = send("POST", "/login/mfa", "", map[string]string{"mfa_token": challenge.MFAToken, "code": code})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	next, _ := mfa.Code(enrollment.Secret, step+1)
+	rr = send("POST", "/login/mfa", "", map[string]string{"mfa_token": challenge.MFAToken, "code": next})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &pair)
+	assert.Equal(t, http.StatusOK, send("GET", "/customers/1/history", pair.AccessToken, nil).Code)
+
+	// Recovery codes work once.
+	recovery := map[string]string{"mfa_token": challenge.MFAToken, "recovery_code": confirmation.RecoveryCodes[0]}
+	assert.Equal(t, http.StatusOK, send("POST", "/login/mfa", "", recovery).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/login/mfa", "", recovery).Code)
+
+	cache.RedisClient.Client.Del(context.Background(), "auth:failures:account:"+email)
+}
+
+func TestMFAPolicy(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	sign := func(role string, amr ...string) string {
+		ensureTestUser(t, role+"@grahamsummitllc.com")
+		token, err := keys.Default().Sign(jwt.MapClaims{
+			"sub":   role + "@grahamsummitllc.com",
+			"roles": []string{role},
+			"amr":   append([]string{"pwd"}, amr...),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"org":   testOrganization(t),
+		})
+		if err != nil {
+			t.Fatal("Failed to sign token:", err)
+		}
+		return token
+	}
+	admin := sign(models.RoleAdmin, "otp")
+
+	router := routes.SetupRouter()
+
+	send := func(method, path, token string, body interface{}) int {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	defer send("PUT", "/mfa/policy", admin, map[string][]string{"required_roles": {}})
+
+	assert.Equal(t, http.StatusBadRequest, send("PUT", "/mfa/policy", admin, map[string][]string{"required_roles": {"nobody"}}))
+	assert.Equal(t, http.StatusOK, send("PUT", "/mfa/policy", admin, map[string][]string{"required_roles": {models.RoleViewer}}))
+
+	assert.Equal(t, http.StatusForbidden, send("GET", "/customers/1/history", sign(models.RoleViewer), nil))
+	assert.Equal(t, http.StatusOK, send("GET", "/customers/1/history", sign(models.RoleViewer, "otp"), nil))
+	assert.Equal(t, http.StatusOK, send("GET", "/customers/1/history", sign(models.RoleEditor), nil))
+}
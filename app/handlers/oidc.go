@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/oidc"
+	"github.com/capgainschristian/go_api_ds/sessions"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+var (
+	errOIDCConflict      = errors.New("Account is already linked to another single sign-on identity")
+	errOIDCAccountExists = errors.New("An account with this email already exists; log in and link single sign-on with POST /oidc/link")
+)
+
+// oidcLogin is what is remembered between sending the user to the provider
+// and their return.
+type oidcLogin struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	// Set when a logged in user started the login to link the identity to
+	// their account.
+	LinkUserID uint `json:"link_user_id,omitempty"`
+}
+
+func oidcStateKey(state string) string {
+	return "oidc:state:" + state
+}
+
+// OIDCLogin starts a single sign-on login by redirecting to the identity
+// provider.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, ok := startOIDC(w, r, 0)
+	if !ok {
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCLink starts a single sign-on login that links the identity to the
+// logged in user's account. It returns the provider URL to send the browser
+// to; the callback is the same as for OIDCLogin.
+func OIDCLink(w http.ResponseWriter, r *http.Request) {
+	if middleware.AuthMethod(r) == middleware.AuthMethodAPIKey {
+		http.Error(w, "API keys cannot link single sign-on", http.StatusForbidden)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.OIDCSubject != nil {
+		http.Error(w, errOIDCConflict.Error(), http.StatusConflict)
+		return
+	}
+
+	authURL, ok := startOIDC(w, r, user.ID)
+	if !ok {
+		return
+	}
+	writeJSON(w, map[string]string{"url": authURL})
+}
+
+// startOIDC remembers a new login and sets the state cookie, and returns the
+// provider URL the browser goes to.
+func startOIDC(w http.ResponseWriter, r *http.Request, linkUserID uint) (string, bool) {
+	provider, err := oidc.Default(r.Context())
+	if err != nil {
+		if errors.Is(err, oidc.ErrNotConfigured) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return "", false
+		}
+		slog.ErrorContext(r.Context(), "OIDC discovery error", "error", err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return "", false
+	}
+
+	state, err := oidc.RandomString(32)
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return "", false
+	}
+	login := oidcLogin{LinkUserID: linkUserID}
+	if login.Nonce, err = oidc.RandomString(32); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return "", false
+	}
+	if login.Verifier, err = oidc.RandomString(32); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return "", false
+	}
+
+	loginJSON, _ := json.Marshal(login)
+	err = cache.RedisClient.Client.Set(r.Context(), oidcStateKey(state), loginJSON, oidcStateTTL).Err()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Redis SET error", "error", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return "", false
+	}
+
+	// The cookie ties the callback to the browser that started the login,
+	// so nobody can log a victim in to the attacker's account.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc/callback",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return provider.AuthCodeURL(state, login.Nonce, login.Verifier), true
+}
+
+// OIDCCallback finishes a single sign-on login: it exchanges the code,
+// validates the ID token, provisions or updates the user and starts the same
+// session Login does.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		http.Error(w, "Identity provider refused the login: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || err != nil || cookie.Value != state {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/oidc/callback", MaxAge: -1})
+
+	stored, err := cache.RedisClient.Client.GetDel(r.Context(), oidcStateKey(state)).Result()
+	if err == redis.Nil {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Redis GETDEL error", "error", err)
+		http.Error(w, "Failed to finish login", http.StatusInternalServerError)
+		return
+	}
+
+	var login oidcLogin
+	if err := json.Unmarshal([]byte(stored), &login); err != nil {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	provider, err := oidc.Default(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), login.Verifier, login.Nonce)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC exchange error", "error", err)
+		http.Error(w, "Single sign-on failed", http.StatusUnauthorized)
+		return
+	}
+
+	// Providers that don't say the email is verified don't get to vouch for
+	// it.
+	if claims.Email == "" || claims.EmailVerified == nil || !*claims.EmailVerified {
+		http.Error(w, "Identity provider did not return a verified email", http.StatusForbidden)
+		return
+	}
+
+	user, err := provisionOIDCUser(database.DB.Db, provider.Config, claims, login.LinkUserID)
+	if errors.Is(err, errOIDCConflict) || errors.Is(err, errOIDCAccountExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC provisioning error", "error", err)
+		http.Error(w, "Failed to provision user", http.StatusInternalServerError)
+		return
+	}
+
+	if user.DisabledAt != nil {
+		http.Error(w, errUserDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Trust the provider's own second factor, if it says it used one.
+	withMFA := false
+	for _, method := range claims.AMR {
+		if method == "mfa" || method == "otp" || method == "hwk" {
+			withMFA = true
+		}
+	}
+
+	loginUser(w, r, user, withMFA)
+}
+
+// provisionOIDCUser finds the user for an identity by its issuer and
+// subject, and sets their role from their groups. The provider is the source
+// of truth for the role of users who log in through it.
+//
+// An identity seen for the first time is linked to the user with id
+// linkUserID, who asked for it through OIDCLink, or else gets a new account.
+// It is never linked to an existing account just because the email matches:
+// that would let whoever controls the address at the provider take the
+// account over.
+func provisionOIDCUser(db *gorm.DB, config oidc.Config, claims *oidc.Claims, linkUserID uint) (*models.User, error) {
+	user := new(models.User)
+	role := config.Role(claims.Groups)
+	now := time.Now()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("oidc_issuer = ? AND oidc_subject = ?", config.Issuer, claims.Subject).First(&user).Error
+		if err == nil {
+			if linkUserID != 0 && user.ID != linkUserID {
+				return errOIDCConflict
+			}
+			return tx.Model(&user).Update("role", role).Error
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if linkUserID != 0 {
+			if err := tx.First(&user, linkUserID).Error; err != nil {
+				return err
+			}
+			if user.OIDCSubject != nil {
+				return errOIDCConflict
+			}
+
+			user.OIDCIssuer = &config.Issuer
+			user.OIDCSubject = &claims.Subject
+			user.Role = role
+			return tx.Model(&user).Select("oidc_issuer", "oidc_subject", "role").Updates(user).Error
+		}
+
+		var taken int64
+		if err := tx.Model(&models.User{}).Where("email = ?", claims.Email).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken > 0 {
+			return errOIDCAccountExists
+		}
+
+		// The user never gets a usable password; they log in through the
+		// provider.
+		unusable, err := randomToken(32)
+		if err != nil {
+			return err
+		}
+		hash, err := hashPassword(unusable)
+		if err != nil {
+			return err
+		}
+
+		*user = models.User{
+			Email:           claims.Email,
+			Password:        string(hash),
+			Role:            role,
+			EmailVerifiedAt: &now,
+			OIDCIssuer:      &config.Issuer,
+			OIDCSubject:     &claims.Subject,
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		// The address may have belonged to a deleted user.
+		return sessions.Forget(context.Background(), cache.RedisClient.Client, user.Email)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
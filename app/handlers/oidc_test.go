@@ -0,0 +1,217 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/oidc"
+	"github.com/capgainschristian/go_api_ds/oidc/oidctest"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func testIdentityProvider(t *testing.T) *oidctest.Server {
+	t.Helper()
+
+	idp, err := oidctest.NewServer("go_api_ds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	provider, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:      idp.URL,
+		ClientID:    "go_api_ds",
+		RedirectURL: "http://localhost:3000/oidc/callback",
+		Scopes:      []string{"openid", "email", "groups"},
+		GroupsClaim: "groups",
+		RoleMapping: map[string]string{"support": models.RoleEditor},
+		DefaultRole: models.RoleViewer,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oidc.SetDefault(provider)
+	t.Cleanup(func() { oidc.SetDefault(nil) })
+
+	return idp
+}
+
+// throughProvider follows authURL through the provider and returns the
+// callback request the browser would make, with the cookies set on started.
+func throughProvider(t *testing.T, started *httptest.ResponseRecorder, authURL string) *http.Request {
+	t.Helper()
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirects.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	req, _ := http.NewRequest("GET", "/oidc/callback?"+callback.RawQuery, nil)
+	for _, cookie := range started.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestOIDCLogin(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	idp := testIdentityProvider(t)
+
+	email := "sso@grahamsummitllc.com"
+	database.DB.Db.Unscoped().Where("email = ? OR oidc_subject = ?", email, "sso-user").Delete(&models.User{})
+	idp.Claims["sub"] = "sso-user"
+	idp.Claims["email"] = email
+	idp.Claims["email_verified"] = true
+	idp.Claims["groups"] = []string{"support"}
+
+	router := routes.SetupRouter()
+	login := func() *http.Request {
+		req, _ := http.NewRequest("GET", "/oidc/login", nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusFound, rr.Code)
+		return throughProvider(t, rr, rr.Header().Get("Location"))
+	}
+
+	callback := login()
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, callback)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	sessionCookie := false
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == "token" && cookie.Value != "" {
+			sessionCookie = true
+		}
+	}
+	assert.True(t, sessionCookie)
+
+	var user models.User
+	assert.NoError(t, database.DB.Db.Where("email = ?", email).First(&user).Error)
+	assert.Equal(t, models.RoleEditor, user.Role)
+	assert.NotNil(t, user.EmailVerifiedAt)
+
+	// Each state works once.
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, callback)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// A callback from another browser, without the state cookie, is refused.
+	callback = login()
+	req, _ := http.NewRequest("GET", callback.URL.String(), nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// The role follows the user's groups on every login.
+	idp.Claims["groups"] = []string{}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, login())
+	assert.Equal(t, http.StatusOK, rr.Code)
+	database.DB.Db.Where("email = ?", email).First(&user)
+	assert.Equal(t, models.RoleViewer, user.Role)
+
+	// The identity is found by its subject, not the email, which may change.
+	idp.Claims["email"] = "sso.renamed@grahamsummitllc.com"
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, login())
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var count int64
+	database.DB.Db.Model(&models.User{}).Where("email = ?", "sso.renamed@grahamsummitllc.com").Count(&count)
+	assert.Zero(t, count)
+
+	// Emails the provider doesn't say are verified are refused.
+	delete(idp.Claims, "email_verified")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, login())
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestOIDCLinksExistingAccountsOnlyWhenAsked(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	idp := testIdentityProvider(t)
+
+	email := "sso.existing@grahamsummitllc.com"
+	database.DB.Db.Unscoped().Where("email = ? OR oidc_subject = ?", email, "sso-existing").Delete(&models.User{})
+	user := models.User{Email: email, Password: "unused", Role: models.RoleViewer}
+	if err := database.DB.Db.Create(&user).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+	idp.Claims["sub"] = "sso-existing"
+	idp.Claims["email"] = email
+	idp.Claims["email_verified"] = true
+	idp.Claims["groups"] = []string{}
+
+	router := routes.SetupRouter()
+
+	// Logging in with a matching email doesn't take the account over.
+	req, _ := http.NewRequest("GET", "/oidc/login", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	callback := throughProvider(t, rr, rr.Header().Get("Location"))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, callback)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	database.DB.Db.First(&user, user.ID)
+	assert.Nil(t, user.OIDCSubject)
+
+	// The owner links it while logged in.
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   email,
+		"roles": []string{models.RoleViewer},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+	req, _ = http.NewRequest("POST", "/oidc/link", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var started struct {
+		URL string `json:"url"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &started))
+	callback = throughProvider(t, rr, started.URL)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, callback)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	database.DB.Db.First(&user, user.ID)
+	if assert.NotNil(t, user.OIDCSubject) {
+		assert.Equal(t, "sso-existing", *user.OIDCSubject)
+	}
+
+	// From then on the identity logs in to it.
+	req, _ = http.NewRequest("GET", "/oidc/login", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	callback = throughProvider(t, rr, rr.Header().Get("Location"))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, callback)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/sessions"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type organizationResponse struct {
+	ID     uint   `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+// activeOrganization picks the organization a new session acts in:
+// preferred, if the user is still a member of it, otherwise the first one
+// they joined. It returns 0 for users in no organization.
+func activeOrganization(tx *gorm.DB, userID, preferred uint) (uint, error) {
+	if preferred != 0 {
+		var count int64
+		err := tx.Model(&models.OrganizationMember{}).
+			Where("organization_id = ? AND user_id = ?", preferred, userID).Count(&count).Error
+		if err != nil {
+			return 0, err
+		}
+		if count > 0 {
+			return preferred, nil
+		}
+	}
+
+	member := new(models.OrganizationMember)
+
+	err := tx.Where("user_id = ?", userID).Order("created_at, organization_id").First(&member).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return member.OrganizationID, nil
+}
+
+// ListOrganizations lists the organizations the current user belongs to,
+// marking the one the request acts in.
+func ListOrganizations(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	orgs := []models.Organization{}
+
+	err := database.DB.Db.
+		Joins("JOIN organization_members ON organization_members.organization_id = organizations.id").
+		Where("organization_members.user_id = ?", user.ID).
+		Order("organizations.id").
+		Find(&orgs).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]organizationResponse, 0, len(orgs))
+	for _, org := range orgs {
+		response = append(response, organizationResponse{
+			ID:     org.ID,
+			Name:   org.Name,
+			Active: org.ID == middleware.OrganizationID(r),
+		})
+	}
+
+	writeJSON(w, response)
+}
+
+// CreateOrganization adds an organization, with the admin creating it as
+// its first member: POST /orgs {"name":"..."}
+func CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Missing organization name", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var count int64
+	database.DB.Db.Model(&models.Organization{}).Where("name = ?", req.Name).Count(&count)
+	if count > 0 {
+		http.Error(w, "An organization with that name already exists", http.StatusConflict)
+		return
+	}
+
+	org := models.Organization{Name: req.Name}
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&org).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.OrganizationMember{OrganizationID: org.ID, UserID: user.ID}).Error
+	})
+	if err != nil {
+		http.Error(w, "Failed to add organization to the database", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(organizationResponse{ID: org.ID, Name: org.Name})
+	if err != nil {
+		http.Error(w, "Failed to serialize organization", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResponse)
+}
+
+// AddOrganizationMember lets a user act in an organization:
+// POST /orgs/{id}/members {"user_id":1}
+func AddOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	org, ok := findOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		UserID uint `json:"user_id"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var count int64
+	database.DB.Db.Model(&models.User{}).Where("id = ?", req.UserID).Count(&count)
+	if count == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	err = database.DB.Db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.OrganizationMember{OrganizationID: org.ID, UserID: req.UserID}).Error
+	if err != nil {
+		http.Error(w, "Failed to add organization member", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Member added successfully."))
+}
+
+// RemoveOrganizationMember takes a user out of an organization and signs
+// them out, since their tokens may still name it:
+// DELETE /orgs/{id}/members/{user_id}
+func RemoveOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	org, ok := findOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := strconv.ParseUint(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	result := database.DB.Db.Where("organization_id = ? AND user_id = ?", org.ID, userID).
+		Delete(&models.OrganizationMember{})
+	if result.Error != nil {
+		http.Error(w, "Failed to remove organization member", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	user := new(models.User)
+	if err := database.DB.Db.First(&user, userID).Error; err == nil {
+		err = sessions.RevokeAll(r.Context(), cache.RedisClient.Client, database.DB.Db, user)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to revoke sessions", "user_id", user.ID, "error", err)
+			http.Error(w, "Member was removed but existing sessions could not be revoked", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Member removed successfully."))
+}
+
+// SwitchOrganization starts a new session acting in another of the user's
+// organizations: POST /orgs/{id}/switch
+func SwitchOrganization(w http.ResponseWriter, r *http.Request) {
+	// A key stays in the organization it was created in.
+	if middleware.AuthMethod(r) == middleware.AuthMethodAPIKey {
+		http.Error(w, "API keys cannot switch organizations", http.StatusBadRequest)
+		return
+	}
+
+	org, ok := findOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	var count int64
+	database.DB.Db.Model(&models.OrganizationMember{}).
+		Where("organization_id = ? AND user_id = ?", org.ID, user.ID).Count(&count)
+	if count == 0 {
+		// Don't reveal which organizations exist.
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+
+	session, err := issueSession(database.DB.Db, w, user, "", middleware.MFAVerified(r), org.ID)
+	if err != nil {
+		http.Error(w, "Unable to encrypt and create token", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, session)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Switched to " + org.Name + "."))
+}
+
+// SeedCustomer is AddCustomer for the development seed endpoint. Seeding
+// has no principal, so customers go to the first organization.
+func SeedCustomer(w http.ResponseWriter, r *http.Request) {
+	org := new(models.Organization)
+
+	err := database.DB.Db.Order("id").First(&org).Error
+	if err != nil {
+		http.Error(w, "No organization to seed customers into", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := middleware.WithPrincipal(r.Context(), &middleware.Principal{OrganizationID: org.ID})
+	AddCustomer(w, r.WithContext(ctx))
+}
+
+// findOrganization loads the organization named by the {id} route
+// variable. It writes the error response itself.
+func findOrganization(w http.ResponseWriter, r *http.Request) (*models.Organization, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid organization id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	org := new(models.Organization)
+	err = database.DB.Db.First(&org, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return org, true
+}
@@ -0,0 +1,169 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestOrganizationsIsolateCustomers(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	// The same email is a customer in both organizations.
+	email := "shared@tenant.example"
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+	defer database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.Customer{})
+
+	orgs := make([]uint, 2)
+	for i, name := range []string{"Tenant A", "Tenant B"} {
+		org := models.Organization{Name: name}
+		if err := database.DB.Db.Where(&org).FirstOrCreate(&org).Error; err != nil {
+			t.Fatal("Failed to create organization:", err)
+		}
+		orgs[i] = org.ID
+	}
+
+	sign := func(orgID uint) string {
+		ensureTestUser(t, "tenant.editor@grahamsummitllc.com")
+		token, err := keys.Default().Sign(jwt.MapClaims{
+			"sub":   "tenant.editor@grahamsummitllc.com",
+			"roles": []string{models.RoleEditor},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"org":   orgID,
+		})
+		if err != nil {
+			t.Fatal("Failed to sign token:", err)
+		}
+		return token
+	}
+
+	router := routes.SetupRouter()
+
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	a, b := sign(orgs[0]), sign(orgs[1])
+
+	assert.Equal(t, http.StatusAccepted, send("POST", "/addcustomer", a, models.Customer{Name: "In A", Email: email, Address: "1 A Street"}).Code)
+	assert.Equal(t, http.StatusAccepted, send("POST", "/addcustomer", b, models.Customer{Name: "In B", Email: email, Address: "1 B Street"}).Code)
+
+	list := func(token string) []models.Customer {
+		rr := send("GET", "/listcustomers?email="+email, token, nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var customers []models.Customer
+		json.Unmarshal(rr.Body.Bytes(), &customers)
+		return customers
+	}
+
+	// Twice each, so the second read comes from each tenant's cache.
+	for i := 0; i < 2; i++ {
+		customers := list(a)
+		if assert.Len(t, customers, 1) {
+			assert.Equal(t, "In A", customers[0].Name)
+		}
+		customers = list(b)
+		if assert.Len(t, customers, 1) {
+			assert.Equal(t, "In B", customers[0].Name)
+		}
+	}
+
+	// A can't touch B's customer.
+	assert.Equal(t, http.StatusOK, send("DELETE", "/deletecustomer", a, models.Customer{Email: email}).Code)
+	assert.Len(t, list(b), 1)
+	assert.Equal(t, http.StatusNotFound, send("DELETE", "/deletecustomer", a, models.Customer{Email: email}).Code)
+
+	// Tokens without an organization can't see any customers.
+	assert.Equal(t, http.StatusForbidden, send("GET", "/listcustomers", sign(0), nil).Code)
+}
+
+func TestSwitchOrganization(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	email := "switcher@grahamsummitllc.com"
+	now := time.Now()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("thisissecured"), 10)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	user := models.User{Email: email, Password: string(hash), Role: models.RoleViewer, EmailVerifiedAt: &now}
+	if err := database.DB.Db.Create(&user).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+	joinTestOrganization(t, email)
+
+	other := models.Organization{Name: "Switch target"}
+	database.DB.Db.Where(&other).FirstOrCreate(&other)
+	outsider := models.Organization{Name: "Not a member"}
+	database.DB.Db.Where(&outsider).FirstOrCreate(&outsider)
+	database.DB.Db.Create(&models.OrganizationMember{OrganizationID: other.ID, UserID: user.ID})
+
+	router := routes.SetupRouter()
+
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	active := func(token string) uint {
+		var orgs []struct {
+			ID     uint `json:"id"`
+			Active bool `json:"active"`
+		}
+		json.Unmarshal(send("GET", "/orgs", token, nil).Body.Bytes(), &orgs)
+		for _, org := range orgs {
+			if org.Active {
+				return org.ID
+			}
+		}
+		return 0
+	}
+
+	var pair tokenPair
+	json.Unmarshal(send("POST", "/login", "", map[string]string{"email": email, "password": "thisissecured"}).Body.Bytes(), &pair)
+	assert.Equal(t, testOrganization(t), active(pair.AccessToken))
+
+	rr := send("POST", "/orgs/"+strconv.FormatUint(uint64(outsider.ID), 10)+"/switch", pair.AccessToken, nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = send("POST", "/orgs/"+strconv.FormatUint(uint64(other.ID), 10)+"/switch", pair.AccessToken, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var switched tokenPair
+	json.Unmarshal(rr.Body.Bytes(), &switched)
+	assert.Equal(t, other.ID, active(switched.AccessToken))
+
+	// Refreshing keeps the organization.
+	rr = send("POST", "/token/refresh", "", map[string]string{"refresh_token": switched.RefreshToken})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var refreshed tokenPair
+	json.Unmarshal(rr.Body.Bytes(), &refreshed)
+	assert.Equal(t, other.ID, active(refreshed.AccessToken))
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/config"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/jobs"
+	"github.com/capgainschristian/go_api_ds/lockout"
+	"github.com/capgainschristian/go_api_ds/mail"
+	"github.com/capgainschristian/go_api_ds/metrics"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/sessions"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errResetInvalid = errors.New("Invalid or expired reset token")
+
+// passwordResetJob mails a reset token to an email, if it belongs to a user.
+var passwordResetJob = jobs.Type[passwordResetPayload]{Name: "password.reset"}
+
+type passwordResetPayload struct {
+	Email string `json:"email"`
+}
+
+// RegisterJobs installs the handlers of the background jobs queued here.
+func RegisterJobs() {
+	jobs.Register(passwordResetJob, func(ctx context.Context, job *jobs.Job, p passwordResetPayload) error {
+		user := new(models.User)
+		err := database.DB.Db.Where("email = ?", p.Email).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return sendPasswordReset(ctx, user)
+	})
+}
+
+// ForgotPassword emails a password reset token. It answers the same way
+// whether or not the email belongs to an account, and queues the same job
+// either way, so neither the answer nor its timing reveals which accounts
+// exist.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		http.Error(w, "Missing user email", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := passwordResetJob.Enqueue(database.DB.Db, passwordResetPayload{Email: req.Email}); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to queue password reset", "error", err)
+		http.Error(w, "Failed to request password reset", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("If the account exists, a password reset email has been sent."))
+}
+
+// sendPasswordReset replaces any outstanding reset token for user with a new
+// one and mails it.
+func sendPasswordReset(ctx context.Context, user *models.User) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	ttl := config.PasswordResetTTL()
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			Update("used_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return mail.Default().Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for this account. If it was you, send this token\n"+
+			"with your new password to %s/password/reset within %s:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.\n", mail.AppURL(), ttl, token),
+	})
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword, then
+// signs the user out everywhere.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, "Missing reset token", http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "Missing user password", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Failed to hash the password", http.StatusInternalServerError)
+		return
+	}
+
+	user := new(models.User)
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		stored := new(models.PasswordResetToken)
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashToken(req.Token)).First(&stored).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errResetInvalid
+			}
+			return err
+		}
+
+		if stored.UsedAt != nil || time.Now().After(stored.ExpiresAt) {
+			return errResetInvalid
+		}
+
+		if err := tx.First(&user, stored.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errResetInvalid
+			}
+			return err
+		}
+
+		if err := tx.Model(&stored).Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Model(&user).Update("password", string(hash)).Error
+	})
+	if err != nil {
+		if errors.Is(err, errResetInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	// Whoever had the old password may also hold a session.
+	err = sessions.RevokeAll(r.Context(), cache.RedisClient.Client, database.DB.Db, user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to revoke sessions", "user_id", user.ID, "error", err)
+		http.Error(w, "Password was reset but existing sessions could not be revoked", http.StatusInternalServerError)
+		return
+	}
+
+	if err := lockout.Reset(r.Context(), cache.RedisClient.Client, user.Email); err != nil {
+		slog.ErrorContext(r.Context(), "Redis lockout error", "error", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Password has been reset."))
+}
+
+// hashPassword hashes a password for storing, timing it for /metrics.
+func hashPassword(password string) ([]byte, error) {
+	defer metrics.ObserveBcrypt("hash", time.Now())
+	return bcrypt.GenerateFromPassword([]byte(password), 10)
+}
+
+// comparePassword checks a password against its stored hash, timing it for
+// /metrics.
+func comparePassword(hash []byte, password string) error {
+	defer metrics.ObserveBcrypt("compare", time.Now())
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
@@ -0,0 +1,106 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/handlers"
+	"github.com/capgainschristian/go_api_ds/jobs"
+	"github.com/capgainschristian/go_api_ds/mail"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordReset(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	dir := t.TempDir()
+	mail.SetDefault(&mail.FileMailer{Dir: dir})
+	defer mail.SetDefault(nil)
+
+	email := "reset@grahamsummitllc.com"
+	now := time.Now()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("forgotten"), 10)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	user := models.User{Email: email, Password: string(hash), Role: models.RoleViewer, EmailVerifiedAt: &now}
+	if err := database.DB.Db.Create(&user).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+
+	handlers.RegisterJobs()
+	pool := jobs.NewPool(database.DB.Db, 1)
+	pool.Start()
+	defer pool.Stop(context.Background())
+
+	router := routes.SetupRouter()
+
+	post := func(path string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Accept", "application/json")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	login := post("/login", map[string]string{"email": email, "password": "forgotten"})
+	assert.Equal(t, http.StatusOK, login.Code)
+	var pair tokenPair
+	json.Unmarshal(login.Body.Bytes(), &pair)
+
+	// Unknown emails get the same answer and no mail.
+	unknown := post("/password/forgot", map[string]string{"email": "nobody@grahamsummitllc.com"})
+	known := post("/password/forgot", map[string]string{"email": email})
+	assert.Equal(t, http.StatusAccepted, known.Code)
+	assert.Equal(t, unknown.Body.String(), known.Body.String())
+
+	// The mail is sent by a background job.
+	var files []string
+	deadline := time.Now().Add(10 * time.Second)
+	for len(files) == 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		files, _ = filepath.Glob(filepath.Join(dir, "*.eml"))
+	}
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	message, _ := os.ReadFile(files[0])
+	token := regexp.MustCompile(`(?m)^([A-Za-z0-9_-]{43})\r?$`).FindStringSubmatch(string(message))
+	if !assert.NotNil(t, token) {
+		return
+	}
+
+	rr := post("/password/reset", map[string]string{"token": token[1], "password": "remembered"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The token only works once.
+	rr = post("/password/reset", map[string]string{"token": token[1], "password": "again"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Sessions from before the reset are gone.
+	req, _ := http.NewRequest("GET", "/customers/1/history", nil)
+	req.Header.Set("Authorization", "Bearer "+pair.AccessToken)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = post("/token/refresh", map[string]string{"refresh_token": pair.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, post("/login", map[string]string{"email": email, "password": "forgotten"}).Code)
+	assert.Equal(t, http.StatusOK, post("/login", map[string]string{"email": email, "password": "remembered"}).Code)
+}
@@ -0,0 +1,107 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	if cache.RedisClient.Client == nil {
+		t.Fatal("Redis is not initialized")
+	}
+
+	t.Setenv("RATE_LIMIT_AUTH", "2")
+	t.Setenv("RATE_LIMIT_API", "1")
+	t.Setenv("RATE_LIMIT_CLIENT", "4")
+
+	first, second := "first.limited@grahamsummitllc.com", "second.limited@grahamsummitllc.com"
+
+	ctx := context.Background()
+	clear := func() {
+		cache.RedisClient.Client.Del(ctx,
+			"ratelimit:auth:ip:192.0.2.7",
+			"ratelimit:client:ip:192.0.2.7",
+			"ratelimit:client:ip:192.0.2.8",
+			"ratelimit:api:user:"+first,
+			"ratelimit:api:user:"+second)
+	}
+	clear()
+	defer clear()
+
+	router := routes.SetupRouter()
+
+	// Public routes count per address.
+	verify := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/verify-email?token=nonsense", nil)
+		req.RemoteAddr = "192.0.2.7:1234"
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := verify()
+	assert.NotEqual(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Remaining"))
+	assert.NotEmpty(t, rr.Header().Get("RateLimit-Reset"))
+
+	assert.NotEqual(t, http.StatusTooManyRequests, verify().Code)
+
+	rr = verify()
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	// Authenticated routes count per user, wherever they come from.
+	orgID := testOrganization(t)
+	list := func(email string) int {
+		ensureTestUser(t, email)
+		token, err := keys.Default().Sign(jwt.MapClaims{
+			"sub":   email,
+			"roles": []string{models.RoleViewer},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"org":   orgID,
+		})
+		if err != nil {
+			t.Fatal("Failed to sign token:", err)
+		}
+
+		req, _ := http.NewRequest("GET", "/listcustomers?limit=1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = "192.0.2.7:1234"
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusOK, list(first))
+	assert.Equal(t, http.StatusTooManyRequests, list(first))
+	assert.Equal(t, http.StatusOK, list(second))
+
+	// Invalid tokens never reach the per user limit, but count per address.
+	guess := func() int {
+		req, _ := http.NewRequest("GET", "/listcustomers?limit=1", nil)
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		req.RemoteAddr = "192.0.2.8:1234"
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusUnauthorized, guess())
+	}
+	assert.Equal(t, http.StatusTooManyRequests, guess())
+}
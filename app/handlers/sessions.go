@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/sessions"
+)
+
+// Logout revokes the access token used for the request and the refresh
+// tokens of its session, and clears both cookies.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	claims := middleware.Claims(r)
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := context.Background()
+	err = sessions.Revoke(ctx, cache.RedisClient.Client, jti, expiresAt.Time)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Redis SET error", "error", err)
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	if sid != "" {
+		err = database.DB.Db.Model(&models.RefreshToken{}).
+			Where("family_id = ? AND revoked_at IS NULL", sid).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			http.Error(w, "Failed to revoke refresh tokens", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     middleware.CSRFCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    "",
+		Path:     "/token/refresh",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Logged out successfully."))
+}
+
+// RevokeUserSessions signs a user out everywhere: DELETE /users/{id}/sessions
+func RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	user, ok := findUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := sessions.RevokeAll(context.Background(), cache.RedisClient.Client, database.DB.Db, user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Revoke sessions error", "error", err)
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("All sessions revoked."))
+}
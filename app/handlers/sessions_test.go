@@ -0,0 +1,88 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLogoutAndRevokeAllSessions(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	email := "sessions@grahamsummitllc.com"
+	now := time.Now()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("thisissecured"), 10)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	user := models.User{Email: email, Password: string(hash), Role: models.RoleViewer, EmailVerifiedAt: &now}
+	if err := database.DB.Db.Create(&user).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+	joinTestOrganization(t, email)
+
+	router := routes.SetupRouter()
+
+	login := func() string {
+		jsonBody, _ := json.Marshal(map[string]string{"email": email, "password": "thisissecured"})
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Accept", "application/json")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var pair tokenPair
+		json.Unmarshal(rr.Body.Bytes(), &pair)
+		return pair.AccessToken
+	}
+
+	send := func(method, path, token string) int {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Logout revokes that one token.
+	token := login()
+	assert.Equal(t, http.StatusOK, send("GET", "/customers/1/history", token))
+	assert.Equal(t, http.StatusOK, send("POST", "/logout", token))
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/customers/1/history", token))
+
+	// Revoking all sessions invalidates every token issued so far.
+	first, second := login(), login()
+
+	ensureTestUser(t, "sessions.admin@grahamsummitllc.com")
+	adminToken, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   "sessions.admin@grahamsummitllc.com",
+		"roles": []string{models.RoleAdmin},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	path := "/users/" + strconv.FormatUint(uint64(user.ID), 10) + "/sessions"
+	assert.Equal(t, http.StatusOK, send("DELETE", path, adminToken))
+
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/customers/1/history", first))
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/customers/1/history", second))
+
+	// New logins work again.
+	assert.Equal(t, http.StatusOK, send("GET", "/customers/1/history", login()))
+}
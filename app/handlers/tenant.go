@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"gorm.io/gorm"
+)
+
+// customersIn starts a query on the customers of the request's active
+// organization. Handlers never query customers any other way, so a missing
+// filter can't show one tenant another's data.
+func customersIn(db *gorm.DB, r *http.Request) *gorm.DB {
+	return db.Model(&models.Customer{}).Scopes(models.InOrganization(middleware.OrganizationID(r)))
+}
+
+// Cache keys are namespaced by organization, as the same email can belong
+// to a customer in each.
+func tenantCachePrefix(orgID uint) string {
+	return "org:" + strconv.FormatUint(uint64(orgID), 10) + ":"
+}
+
+func customerCacheKey(orgID uint, email string) string {
+	return tenantCachePrefix(orgID) + "customer:" + email
+}
+
+func customerListCacheKey(orgID uint, limit, offset int, filter customerFilter) string {
+	key := fmt.Sprintf("%scustomers:limit=%d:offset=%d", tenantCachePrefix(orgID), limit, offset)
+	if !filter.IsEmpty() {
+		key += ":filter=" + filter.CacheKey()
+	}
+	return key
+}
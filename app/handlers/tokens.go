@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/config"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const refreshCookie = "refresh_token"
+
+var (
+	errRefreshInvalid = errors.New("Invalid refresh token")
+	errRefreshReused  = errors.New("Refresh token reuse detected; all sessions from this login were revoked")
+)
+
+type tokenResponse struct {
+	AccessToken      string    `json:"access_token"`
+	TokenType        string    `json:"token_type"`
+	ExpiresIn        int64     `json:"expires_in"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+	// Only needed by browsers using the cookies; see middleware.CSRFHeader.
+	CSRFToken string `json:"csrf_token"`
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// issueSession mints an access token and a refresh token for user and sets
+// both as cookies. familyID continues an existing refresh token family; pass
+// "" to start a new one, as Login does. The family doubles as the session id
+// (the sid claim) so Logout can revoke the refresh tokens too. withMFA
+// records, in the amr claim, that the login used a second factor. orgID is
+// the organization the session acts in (the org claim); see
+// activeOrganization.
+func issueSession(tx *gorm.DB, w http.ResponseWriter, user *models.User, familyID string, withMFA bool, orgID uint) (*tokenResponse, error) {
+	accessExpiresAt := time.Now().Add(config.AccessTokenTTL())
+
+	var err error
+	if familyID == "" {
+		familyID, err = randomToken(16)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	jti, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	csrf, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   user.Email,
+		"uid":   user.ID,
+		"roles": []string{user.Role},
+		"exp":   accessExpiresAt.Unix(),
+		"jti":   jti,
+		"sid":   familyID,
+		"gen":   user.TokenGeneration,
+		"amr":   amr(withMFA),
+		"csrf":  csrf,
+		"org":   orgID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	refreshExpiresAt := time.Now().Add(config.RefreshTokenTTL())
+
+	err = tx.Create(&models.RefreshToken{
+		UserID:         user.ID,
+		FamilyID:       familyID,
+		TokenHash:      hashToken(refreshToken),
+		ExpiresAt:      refreshExpiresAt,
+		MFA:            withMFA,
+		OrganizationID: orgID,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the token as a cookie. Lax keeps it off cross-site POSTs while
+	// still sending it when following a link to the API.
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    tokenString,
+		Path:     "/",
+		Expires:  accessExpiresAt,
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// Readable by scripts on purpose, so they can send it back as
+	// middleware.CSRFHeader.
+	http.SetCookie(w, &http.Cookie{
+		Name:     middleware.CSRFCookie,
+		Value:    csrf,
+		Path:     "/",
+		Expires:  accessExpiresAt,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+	})
+	// The refresh token is only ever sent to the refresh endpoint.
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    refreshToken,
+		Path:     "/token/refresh",
+		Expires:  refreshExpiresAt,
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return &tokenResponse{
+		AccessToken:      tokenString,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(config.AccessTokenTTL().Seconds()),
+		ExpiresAt:        accessExpiresAt.UTC(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt.UTC(),
+		CSRFToken:        csrf,
+	}, nil
+}
+
+// RefreshToken exchanges a refresh token, from the JSON body or the
+// refresh_token cookie, for a new access token and a new refresh token. Each
+// refresh token works once; presenting one that was already exchanged means
+// it was stolen (or the client is broken), so its whole family is revoked.
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.RefreshToken == "" {
+		if cookie, err := r.Cookie(refreshCookie); err == nil {
+			req.RefreshToken = cookie.Value
+		}
+	}
+	if req.RefreshToken == "" {
+		http.Error(w, "Missing refresh token", http.StatusBadRequest)
+		return
+	}
+
+	var session *tokenResponse
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		stored := new(models.RefreshToken)
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashToken(req.RefreshToken)).First(&stored).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errRefreshInvalid
+			}
+			return err
+		}
+
+		if stored.RevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+			return errRefreshInvalid
+		}
+
+		now := time.Now()
+
+		if stored.UsedAt != nil {
+			return errRefreshReused
+		}
+
+		user := new(models.User)
+		if err := tx.First(&user, stored.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errRefreshInvalid
+			}
+			return err
+		}
+		if user.DisabledAt != nil {
+			return errRefreshInvalid
+		}
+
+		if err := tx.Model(&stored).Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		// The user may have been removed from the organization since.
+		orgID, err := activeOrganization(tx, user.ID, stored.OrganizationID)
+		if err != nil {
+			return err
+		}
+
+		session, err = issueSession(tx, w, user, stored.FamilyID, stored.MFA, orgID)
+		return err
+	})
+
+	if errors.Is(err, errRefreshReused) {
+		// Revoke outside the rolled back transaction so it sticks.
+		database.DB.Db.Model(&models.RefreshToken{}).
+			Where("family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = ?) AND revoked_at IS NULL", hashToken(req.RefreshToken)).
+			Update("revoked_at", time.Now())
+	}
+	if err != nil {
+		if errors.Is(err, errRefreshInvalid) || errors.Is(err, errRefreshReused) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, session)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Token refreshed successfully."))
+}
+
+// amr lists the authentication methods behind a session, as in RFC 8176.
+func amr(withMFA bool) []string {
+	if withMFA {
+		return []string{"pwd", "otp"}
+	}
+	return []string{"pwd"}
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// JWKS publishes the public keys tokens can be verified with:
+// GET /.well-known/jwks.json
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, keys.Default().JWKS())
+}
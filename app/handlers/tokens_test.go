@@ -0,0 +1,75 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	email := "refresh@grahamsummitllc.com"
+	now := time.Now()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("thisissecured"), 10)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	if err := database.DB.Db.Create(&models.User{Email: email, Password: string(hash), Role: models.RoleViewer, EmailVerifiedAt: &now}).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	post := func(path string, body interface{}) (*httptest.ResponseRecorder, tokenPair) {
+		jsonBody, _ := json.Marshal(body)
+		req, err := http.NewRequest("POST", path, bytes.NewBuffer(jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		var pair tokenPair
+		json.Unmarshal(rr.Body.Bytes(), &pair)
+		return rr, pair
+	}
+
+	rr, first := post("/login", map[string]string{"email": email, "password": "thisissecured"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEmpty(t, first.RefreshToken)
+
+	// Rotation hands out a new refresh token.
+	rr, second := post("/token/refresh", map[string]string{"refresh_token": first.RefreshToken})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEmpty(t, second.AccessToken)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+	// Replaying the first token revokes the family...
+	rr, _ = post("/token/refresh", map[string]string{"refresh_token": first.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// ...including the token it was rotated into.
+	rr, _ = post("/token/refresh", map[string]string{"refresh_token": second.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr, _ = post("/token/refresh", map[string]string{"refresh_token": "not-a-token"})
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	netmail "net/mail"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/sessions"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+var errUserDisabled = errors.New("Account has been disabled")
+
+// userResponse is how users are shown by the API. Handlers never serialize
+// models.User directly, so secrets such as the password hash and TOTP secret
+// can't leak through a new field or a forgotten json tag.
+type userResponse struct {
+	ID               uint      `json:"id"`
+	Email            string    `json:"email"`
+	Role             string    `json:"role"`
+	EmailVerified    bool      `json:"email_verified"`
+	TwoFactorEnabled bool      `json:"two_factor_enabled"`
+	SingleSignOn     bool      `json:"single_sign_on"`
+	Disabled         bool      `json:"disabled"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+func toUserResponse(user *models.User) userResponse {
+	return userResponse{
+		ID:               user.ID,
+		Email:            user.Email,
+		Role:             user.Role,
+		EmailVerified:    user.EmailVerifiedAt != nil,
+		TwoFactorEnabled: user.TOTPEnabledAt != nil,
+		SingleSignOn:     user.OIDCSubject != nil,
+		Disabled:         user.DisabledAt != nil,
+		CreatedAt:        user.CreatedAt,
+		UpdatedAt:        user.UpdatedAt,
+	}
+}
+
+// GetMe returns the current user.
+func GetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, toUserResponse(user))
+}
+
+// UpdateMe changes the current user's email given their password, so a
+// stolen session can't move the account to an address the thief controls.
+// The new address has to be verified, and every session is signed out since
+// tokens name the user by email.
+func UpdateMe(w http.ResponseWriter, r *http.Request) {
+	if middleware.AuthMethod(r) == middleware.AuthMethodAPIKey {
+		http.Error(w, "API keys cannot change account details", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Email           string `json:"email"`
+		CurrentPassword string `json:"current_password"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Email == "" || req.Email == user.Email {
+		writeJSON(w, toUserResponse(user))
+		return
+	}
+
+	if addr, err := netmail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+		http.Error(w, "Invalid user email", http.StatusBadRequest)
+		return
+	}
+
+	err = comparePassword([]byte(user.Password), req.CurrentPassword)
+	if err != nil {
+		http.Error(w, "Incorrect current password", http.StatusForbidden)
+		return
+	}
+
+	// The unique index on email settles races between two users claiming
+	// the same address.
+	oldEmail := user.Email
+	err = database.DB.Db.Model(&user).Updates(map[string]interface{}{
+		"email":             req.Email,
+		"email_verified_at": nil,
+	}).Error
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		http.Error(w, "Email is already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to update user", "user_id", user.ID, "error", err)
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+	user.Email = req.Email
+	user.EmailVerifiedAt = nil
+
+	// RevokeAll also replaces any generation cached for the new address.
+	ctx := r.Context()
+	if err := sessions.RevokeAll(ctx, cache.RedisClient.Client, database.DB.Db, user); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to revoke sessions", "user_id", user.ID, "error", err)
+	}
+	if err := sessions.RevokeSubject(ctx, cache.RedisClient.Client, oldEmail); err != nil {
+		slog.ErrorContext(r.Context(), "Redis SET error", "error", err)
+	}
+	if err := sendVerification(ctx, user); err != nil {
+		slog.ErrorContext(r.Context(), "Verification email failed", "user_id", user.ID, "error", err)
+	}
+
+	writeJSON(w, toUserResponse(user))
+}
+
+// ChangePassword sets a new password given the current one. Other sessions
+// are signed out; the caller gets a fresh session.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if middleware.AuthMethod(r) == middleware.AuthMethodAPIKey {
+		http.Error(w, "API keys cannot change passwords", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.NewPassword == "" {
+		http.Error(w, "Missing new password", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	err = comparePassword([]byte(user.Password), req.CurrentPassword)
+	if err != nil {
+		http.Error(w, "Incorrect current password", http.StatusForbidden)
+		return
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash the password", http.StatusInternalServerError)
+		return
+	}
+
+	err = database.DB.Db.Model(&user).Update("password", string(hash)).Error
+	if err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	err = sessions.RevokeAll(r.Context(), cache.RedisClient.Client, database.DB.Db, user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to revoke sessions", "user_id", user.ID, "error", err)
+		http.Error(w, "Password was changed but existing sessions could not be revoked", http.StatusInternalServerError)
+		return
+	}
+
+	orgID, err := activeOrganization(database.DB.Db, user.ID, middleware.OrganizationID(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	session, err := issueSession(database.DB.Db, w, user, "", middleware.MFAVerified(r), orgID)
+	if err != nil {
+		http.Error(w, "Unable to encrypt and create token", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, session)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Password changed successfully."))
+}
+
+// ListUsers lists users for admins: GET /users?role=editor&limit=10&offset=0
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := 10
+	offset := 0
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil {
+		limit = l
+	}
+	if o, err := strconv.Atoi(query.Get("offset")); err == nil {
+		offset = o
+	}
+
+	db := database.DB.Db.Order("id")
+	if role := query.Get("role"); role != "" {
+		db = db.Where("role = ?", role)
+	}
+
+	users := []models.User{}
+	if err := db.Limit(limit).Offset(offset).Find(&users).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]userResponse, len(users))
+	for i := range users {
+		response[i] = toUserResponse(&users[i])
+	}
+	writeJSON(w, response)
+}
+
+// UpdateUser lets an admin change a user's role or disable them. Either
+// change signs the user out everywhere, so old tokens can't keep the old
+// role.
+func UpdateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role     *string `json:"role"`
+		Disabled *bool   `json:"disabled"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user, ok := findUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Admins can't lock themselves out.
+	if user.Email == middleware.Subject(r) {
+		http.Error(w, "You cannot change your own role or disable yourself", http.StatusBadRequest)
+		return
+	}
+
+	updates := map[string]interface{}{}
+	if req.Role != nil {
+		if !middleware.ValidRole(*req.Role) {
+			http.Error(w, "Invalid role: "+*req.Role, http.StatusBadRequest)
+			return
+		}
+		updates["role"] = *req.Role
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		var disabledAt *time.Time
+		if *req.Disabled {
+			now := time.Now()
+			disabledAt = &now
+		}
+		updates["disabled_at"] = disabledAt
+		user.DisabledAt = disabledAt
+	}
+
+	if len(updates) == 0 {
+		writeJSON(w, toUserResponse(user))
+		return
+	}
+
+	err = database.DB.Db.Model(&user).Updates(updates).Error
+	if err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	err = sessions.RevokeAll(r.Context(), cache.RedisClient.Client, database.DB.Db, user)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to revoke sessions", "user_id", user.ID, "error", err)
+		http.Error(w, "User was updated but existing sessions could not be revoked", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, toUserResponse(user))
+}
+
+// DeleteUser removes a user, everything that lets them authenticate, and the
+// webhook endpoints they registered, which would otherwise keep receiving
+// customer events.
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := findUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.Email == middleware.Subject(r) {
+		http.Error(w, "You cannot delete yourself", http.StatusBadRequest)
+		return
+	}
+
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{
+			&models.RefreshToken{},
+			&models.APIKey{},
+			&models.RecoveryCode{},
+			&models.PasswordResetToken{},
+			&models.EmailVerificationToken{},
+			&models.OrganizationMember{},
+		} {
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		// Soft deleted, like DeleteWebhook does, so the delivery log stays.
+		err := tx.Where("owner_email = ?", user.Email).Delete(&models.WebhookEndpoint{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sessions.RevokeSubject(r.Context(), cache.RedisClient.Client, user.Email); err != nil {
+		slog.ErrorContext(r.Context(), "Redis SET error", "error", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("User deleted successfully."))
+}
+
+// findUser loads the user named by the {id} route variable. It writes the
+// error response itself.
+func findUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	user := new(models.User)
+	err = database.DB.Db.First(&user, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,155 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/capgainschristian/go_api_ds/sessions"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+func TestUserEndpoints(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	email := "self-service@grahamsummitllc.com"
+	now := time.Now()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("thisissecured"), 10)
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	user := models.User{Email: email, Password: string(hash), Role: models.RoleViewer, EmailVerifiedAt: &now}
+	if err := database.DB.Db.Create(&user).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+	userPath := "/users/" + strconv.FormatUint(uint64(user.ID), 10)
+
+	ensureTestUser(t, "admin@grahamsummitllc.com")
+	admin, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":   "admin@grahamsummitllc.com",
+		"roles": []string{models.RoleAdmin},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	router := routes.SetupRouter()
+
+	send := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Accept", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(password string) (int, string) {
+		rr := send("POST", "/login", "", map[string]string{"email": email, "password": password})
+		var pair tokenPair
+		json.Unmarshal(rr.Body.Bytes(), &pair)
+		return rr.Code, pair.AccessToken
+	}
+
+	_, token := login("thisissecured")
+
+	rr := send("GET", "/users/me", token, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), "password")
+	assert.NotContains(t, rr.Body.String(), string(hash))
+	var me map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &me)
+	assert.Equal(t, email, me["email"])
+	assert.Equal(t, models.RoleViewer, me["role"])
+
+	// Viewers can't use the admin endpoints.
+	assert.Equal(t, http.StatusForbidden, send("GET", "/users", token, nil).Code)
+
+	rr = send("POST", "/users/me/password", token, map[string]string{"current_password": "wrong", "new_password": "anewpassword"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = send("POST", "/users/me/password", token, map[string]string{"current_password": "thisissecured", "new_password": "anewpassword"})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var pair tokenPair
+	json.Unmarshal(rr.Body.Bytes(), &pair)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/users/me", token, nil).Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/users/me", pair.AccessToken, nil).Code)
+
+	code, _ := login("thisissecured")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, token = login("anewpassword")
+	assert.Equal(t, http.StatusOK, code)
+
+	// Changing the email takes the password, and can't take another
+	// user's address.
+	rr = send("PATCH", "/users/me", token, map[string]string{"email": "moved@grahamsummitllc.com"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = send("PATCH", "/users/me", token, map[string]string{"email": "moved@grahamsummitllc.com", "current_password": "wrong"})
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = send("PATCH", "/users/me", token, map[string]string{"email": "admin@grahamsummitllc.com", "current_password": "anewpassword"})
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Equal(t, http.StatusOK, send("GET", "/users/me", token, nil).Code)
+
+	// Admins see users without their secrets.
+	rr = send("GET", "/users?role=viewer&limit=1000", admin, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), email)
+	assert.NotContains(t, rr.Body.String(), "password")
+
+	rr = send("PATCH", userPath, admin, map[string]string{"role": "superuser"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = send("PATCH", userPath, admin, map[string]string{"role": models.RoleEditor})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/users/me", token, nil).Code)
+
+	rr = send("PATCH", userPath, admin, map[string]bool{"disabled": true})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	code, _ = login("anewpassword")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	rr = send("PATCH", userPath, admin, map[string]bool{"disabled": false})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	code, token = login("anewpassword")
+	assert.Equal(t, http.StatusOK, code)
+
+	endpoint := models.WebhookEndpoint{
+		OwnerEmail: email,
+		URL:        "https://example.com/hook",
+		Secret:     "test-secret",
+		EventTypes: models.JSON(`["customer.created"]`),
+		Active:     true,
+	}
+	if err := database.DB.Db.Create(&endpoint).Error; err != nil {
+		t.Fatal("Failed to create endpoint:", err)
+	}
+	defer database.DB.Db.Unscoped().Delete(&endpoint)
+
+	rr = send("DELETE", userPath, admin, nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/users/me", token, nil).Code)
+	assert.ErrorIs(t, database.DB.Db.First(&models.WebhookEndpoint{}, endpoint.ID).Error, gorm.ErrRecordNotFound,
+		"the deleted user's webhooks should stop receiving events")
+	assert.Equal(t, http.StatusNotFound, send("DELETE", userPath, admin, nil).Code)
+
+	// The tokens stay refused after the revocation drops out of Redis.
+	sessions.Forget(context.Background(), cache.RedisClient.Client, email)
+	assert.Equal(t, http.StatusUnauthorized, send("GET", "/users/me", token, nil).Code)
+}
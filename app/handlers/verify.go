@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/config"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/mail"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errVerificationInvalid = errors.New("Invalid or expired verification token")
+
+const (
+	// One resend per address per minute, and a handful per client per hour.
+	resendEmailInterval = time.Minute
+	resendIPWindow      = time.Hour
+	resendIPLimit       = 10
+)
+
+// sendVerification replaces any outstanding verification token for user
+// with a new one and mails the link.
+func sendVerification(ctx context.Context, user *models.User) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	ttl := config.EmailVerificationTTL()
+
+	err = database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.EmailVerificationToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).
+			Update("used_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.EmailVerificationToken{
+			UserID:    user.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return mail.Default().Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Follow this link within %s to finish creating your account:\n\n"+
+			"%s/verify-email?token=%s\n\n"+
+			"If you didn't sign up, you can ignore this email.\n", ttl, mail.AppURL(), token),
+	})
+}
+
+// VerifyEmail marks the user owning a verification token as verified. It is
+// a GET so the link in the email works when clicked.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing verification token", http.StatusBadRequest)
+		return
+	}
+
+	err := database.DB.Db.Transaction(func(tx *gorm.DB) error {
+		stored := new(models.EmailVerificationToken)
+
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashToken(token)).First(&stored).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errVerificationInvalid
+			}
+			return err
+		}
+
+		if stored.UsedAt != nil || time.Now().After(stored.ExpiresAt) {
+			return errVerificationInvalid
+		}
+
+		now := time.Now()
+		if err := tx.Model(&stored).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).
+			Where("id = ? AND email_verified_at IS NULL", stored.UserID).
+			Update("email_verified_at", now).Error
+	})
+	if err != nil {
+		if errors.Is(err, errVerificationInvalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Email verified."))
+}
+
+// ResendVerification mails a new verification link. Like ForgotPassword it
+// answers the same way for unknown and already verified addresses, and the
+// rate limits apply to every address so they don't reveal which exist.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Email == "" {
+		http.Error(w, "Missing user email", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	wait, err := resendAllowed(ctx, cache.RedisClient.Client, req.Email, clientIP(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Redis rate limit error", "error", err)
+		http.Error(w, "Failed to check rate limit", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())))
+		http.Error(w, "Too many verification emails requested, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user := new(models.User)
+	err = database.DB.Db.Where("email = ?", req.Email).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil && user.EmailVerifiedAt == nil {
+		if err := sendVerification(ctx, user); err != nil {
+			slog.ErrorContext(r.Context(), "Verification email failed", "user_id", user.ID, "error", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("If the account exists and is not verified, a verification email has been sent."))
+}
+
+// resendAllowed returns how long the client has to wait before another
+// verification email may be sent to email, or zero if it may go ahead.
+func resendAllowed(ctx context.Context, rdb *redis.Client, email, ip string) (time.Duration, error) {
+	ipKey := "auth:verify-resend:ip:" + ip
+	count, err := rdb.Incr(ctx, ipKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		rdb.Expire(ctx, ipKey, resendIPWindow)
+	}
+	if count > resendIPLimit {
+		return retryAfter(ctx, rdb, ipKey)
+	}
+
+	emailKey := "auth:verify-resend:email:" + email
+	ok, err := rdb.SetNX(ctx, emailKey, 1, resendEmailInterval).Result()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return retryAfter(ctx, rdb, emailKey)
+	}
+	return 0, nil
+}
+
+func retryAfter(ctx context.Context, rdb *redis.Client, key string) (time.Duration, error) {
+	ttl, err := rdb.TTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl, nil
+}
@@ -0,0 +1,87 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/mail"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailVerification(t *testing.T) {
+	if database.DB.Db == nil {
+		t.Fatal("Database is not initialized")
+	}
+
+	dir := t.TempDir()
+	mail.SetDefault(&mail.FileMailer{Dir: dir})
+	defer mail.SetDefault(nil)
+
+	email := "verify@grahamsummitllc.com"
+	database.DB.Db.Unscoped().Where("email = ?", email).Delete(&models.User{})
+	cache.RedisClient.Client.Del(context.Background(),
+		"auth:verify-resend:email:"+email,
+		"auth:verify-resend:ip:192.0.2.1")
+
+	router := routes.SetupRouter()
+
+	send := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	credentials := map[string]string{"email": email, "password": "thisissecured"}
+
+	rr := send("POST", "/signup", map[string]string{"email": email + ",", "password": "thisissecured"})
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = send("POST", "/signup", credentials)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	rr = send("POST", "/login", credentials)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// A resend replaces the first link; asking again right away is refused.
+	rr = send("POST", "/verify-email/resend", map[string]string{"email": email})
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	rr = send("POST", "/verify-email/resend", map[string]string{"email": email})
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if !assert.Len(t, files, 2) {
+		return
+	}
+	pattern := regexp.MustCompile(`/verify-email\?token=([A-Za-z0-9_-]+)`)
+	first, _ := os.ReadFile(files[0])
+	second, _ := os.ReadFile(files[1])
+	oldToken := pattern.FindStringSubmatch(string(first))
+	newToken := pattern.FindStringSubmatch(string(second))
+	if !assert.NotNil(t, oldToken) || !assert.NotNil(t, newToken) {
+		return
+	}
+
+	rr = send("GET", "/verify-email?token="+oldToken[1], nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = send("GET", "/verify-email?token="+newToken[1], nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = send("POST", "/login", credentials)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/outbox"
+	"github.com/capgainschristian/go_api_ds/webhooks"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+var webhookEventTypes = map[string]bool{
+	outbox.CustomerCreated: true,
+	outbox.CustomerUpdated: true,
+	outbox.CustomerDeleted: true,
+}
+
+type webhookRequest struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"event_types"`
+	Active     *bool    `json:"active"`
+}
+
+// webhookCreatedResponse is the only time the signing secret is returned.
+type webhookCreatedResponse struct {
+	models.WebhookEndpoint
+	Secret string `json:"secret"`
+}
+
+func (req webhookRequest) validate(ctx context.Context) error {
+	if err := webhooks.ValidateURL(ctx, req.URL); err != nil {
+		return err
+	}
+	if len(req.EventTypes) == 0 {
+		return errors.New("Missing webhook event types")
+	}
+	for _, eventType := range req.EventTypes {
+		if !webhookEventTypes[eventType] {
+			return errors.New("Unknown event type: " + eventType)
+		}
+	}
+	return nil
+}
+
+// CreateWebhook registers an endpoint for the current user. If no secret is
+// supplied one is generated; either way it is returned only in this response.
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, "Failed to generate webhook secret", http.StatusInternalServerError)
+			return
+		}
+		req.Secret = hex.EncodeToString(b)
+	}
+
+	eventTypes, _ := json.Marshal(req.EventTypes)
+
+	endpoint := models.WebhookEndpoint{
+		OrganizationID: middleware.OrganizationID(r),
+		OwnerEmail:     middleware.Subject(r),
+		URL:            req.URL,
+		Secret:         req.Secret,
+		EventTypes:     eventTypes,
+		Active:         true,
+	}
+
+	err = database.DB.Db.Create(&endpoint).Error
+	if err != nil {
+		http.Error(w, "Failed to add webhook to the database", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(webhookCreatedResponse{WebhookEndpoint: endpoint, Secret: endpoint.Secret})
+	if err != nil {
+		http.Error(w, "Failed to serialize webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonResponse)
+}
+
+// ListWebhooks lists the current user's endpoints.
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	endpoints := []models.WebhookEndpoint{}
+
+	err := database.DB.Db.Scopes(models.InOrganization(middleware.OrganizationID(r))).
+		Where("owner_email = ?", middleware.Subject(r)).Order("id").Find(&endpoints).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, endpoints)
+}
+
+// UpdateWebhook changes an endpoint's url, event types or active flag.
+// Re-activating an endpoint that was disabled for failing resets its failure
+// count.
+func UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var req webhookRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Checking for empty fields to allow updating individual field without resetting the others
+	if req.URL == "" {
+		req.URL = endpoint.URL
+	}
+	if len(req.EventTypes) == 0 {
+		json.Unmarshal(endpoint.EventTypes, &req.EventTypes)
+	}
+	if err := req.validate(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	endpoint.URL = req.URL
+	endpoint.EventTypes, _ = json.Marshal(req.EventTypes)
+	if req.Secret != "" {
+		endpoint.Secret = req.Secret
+	}
+	if req.Active != nil {
+		if *req.Active && !endpoint.Active {
+			endpoint.ConsecutiveFailures = 0
+			endpoint.DisabledAt = nil
+		}
+		endpoint.Active = *req.Active
+	}
+
+	err = database.DB.Db.Save(&endpoint).Error
+	if err != nil {
+		http.Error(w, "Failed to update webhook in database", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, endpoint)
+}
+
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := database.DB.Db.Delete(&endpoint).Error
+	if err != nil {
+		http.Error(w, "Failed to delete webhook from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Webhook deleted successfully."))
+}
+
+// ListWebhookDeliveries returns an endpoint's delivery log, newest first:
+// GET /webhooks/{id}/deliveries?limit=10&offset=0
+func ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := findWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	// Provide defaults so no input required
+	limit := 10
+	offset := 0
+
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil {
+		limit = l
+	}
+	if o, err := strconv.Atoi(query.Get("offset")); err == nil {
+		offset = o
+	}
+
+	deliveries := []models.WebhookDelivery{}
+
+	err := database.DB.Db.Where("endpoint_id = ?", endpoint.ID).
+		Order("id DESC").Limit(limit).Offset(offset).Find(&deliveries).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, deliveries)
+}
+
+// RedeliverWebhook queues a delivery to be sent again, whatever its status.
+func RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid delivery id", http.StatusBadRequest)
+		return
+	}
+
+	delivery := new(models.WebhookDelivery)
+
+	// Joining on the endpoint keeps users to their own deliveries.
+	err = database.DB.Db.
+		Joins("JOIN webhook_endpoints ON webhook_endpoints.id = webhook_deliveries.endpoint_id AND webhook_endpoints.deleted_at IS NULL").
+		Where("webhook_deliveries.id = ? AND webhook_endpoints.owner_email = ? AND webhook_endpoints.organization_id = ?",
+			deliveryID, middleware.Subject(r), middleware.OrganizationID(r)).
+		First(&delivery).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = webhooks.Redeliver(database.DB.Db, middleware.OrganizationID(r), delivery)
+	if err != nil {
+		http.Error(w, "Failed to queue redelivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Redelivery queued."))
+}
+
+// findWebhook loads the endpoint named in the route, as long as it belongs
+// to the current user. It writes the error response itself.
+func findWebhook(w http.ResponseWriter, r *http.Request) (*models.WebhookEndpoint, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook id", http.StatusBadRequest)
+		return nil, false
+	}
+
+	endpoint := new(models.WebhookEndpoint)
+
+	err = database.DB.Db.Scopes(models.InOrganization(middleware.OrganizationID(r))).
+		Where("id = ? AND owner_email = ?", id, middleware.Subject(r)).First(&endpoint).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return endpoint, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	jsonResponse, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResponse)
+}
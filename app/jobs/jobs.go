@@ -0,0 +1,119 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"gorm.io/gorm"
+)
+
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Job is the handle a running job receives. It wraps the stored row and lets
+// the job report progress while it works.
+type Job struct {
+	*models.Job
+	db    *gorm.DB
+	claim string
+}
+
+// SetProgress records how far along the job is, as a percentage.
+func (j *Job) SetProgress(percent int) error {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	j.Progress = percent
+	return j.db.Model(&models.Job{}).Where("id = ? AND claimed_by = ?", j.ID, j.claim).Update("progress", percent).Error
+}
+
+// Type ties a job name to the Go type of its payload so that enqueueing and
+// handling a job are both checked by the compiler:
+//
+//	var PurgeCustomers = jobs.Type[PurgePayload]{Name: "customers.purge"}
+//
+//	jobs.Register(PurgeCustomers, func(ctx context.Context, job *jobs.Job, p PurgePayload) error { ... })
+//	PurgeCustomers.Enqueue(database.DB.Db, PurgePayload{...})
+type Type[T any] struct {
+	Name string
+}
+
+// Enqueue stores a job to run as soon as a worker is free. Pass a transaction
+// to enqueue atomically with other writes.
+func (t Type[T]) Enqueue(db *gorm.DB, payload T) (*models.Job, error) {
+	return t.EnqueueAt(db, payload, time.Now())
+}
+
+// EnqueueIn stores a job done for an organization, whose members can then
+// follow it through GET /jobs/{id}.
+func (t Type[T]) EnqueueIn(db *gorm.DB, orgID uint, payload T) (*models.Job, error) {
+	return t.enqueue(db, orgID, payload, time.Now())
+}
+
+// EnqueueAt stores a job that will not be claimed before runAt.
+func (t Type[T]) EnqueueAt(db *gorm.DB, payload T, runAt time.Time) (*models.Job, error) {
+	return t.enqueue(db, 0, payload, runAt)
+}
+
+func (t Type[T]) enqueue(db *gorm.DB, orgID uint, payload T, runAt time.Time) (*models.Job, error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("serialize %s payload: %w", t.Name, err)
+	}
+
+	job := &models.Job{
+		OrganizationID: orgID,
+		Type:           t.Name,
+		Payload:        payloadJSON,
+		Status:         StatusQueued,
+		RunAt:          runAt,
+		MaxAttempts:    5,
+	}
+	if err := db.Create(job).Error; err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+type handlerFunc func(ctx context.Context, job *Job) error
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]handlerFunc{}
+)
+
+// Register installs the function that runs jobs of the given type. It is
+// meant to be called during start up, before the pool is started.
+func Register[T any](t Type[T], fn func(ctx context.Context, job *Job, payload T) error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	registry[t.Name] = func(ctx context.Context, job *Job) error {
+		var payload T
+		if len(job.Payload) > 0 {
+			if err := json.Unmarshal(job.Payload, &payload); err != nil {
+				return fmt.Errorf("deserialize %s payload: %w", t.Name, err)
+			}
+		}
+		return fn(ctx, job, payload)
+	}
+}
+
+func lookup(jobType string) (handlerFunc, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	fn, ok := registry[jobType]
+	return fn, ok
+}
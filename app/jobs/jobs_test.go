@@ -0,0 +1,170 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/jobs"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type echoPayload struct {
+	Message string `json:"message"`
+}
+
+var (
+	echoJob   = jobs.Type[echoPayload]{Name: "test.echo"}
+	flakyJob  = jobs.Type[echoPayload]{Name: "test.flaky"}
+	stolenJob = jobs.Type[echoPayload]{Name: "test.stolen"}
+)
+
+func TestMain(m *testing.M) {
+
+	database.ConnectDb()
+
+	code := m.Run()
+
+	os.Exit(code)
+}
+
+func waitForStatus(t *testing.T, id uint, status string) models.Job {
+	t.Helper()
+
+	var job models.Job
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		database.DB.Db.First(&job, id)
+		if job.Status == status {
+			return job
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("job %d never reached status %q (last status %q)", id, status, job.Status)
+	return job
+}
+
+func TestJobRunsAndReportsProgress(t *testing.T) {
+	received := make(chan string, 1)
+	jobs.Register(echoJob, func(ctx context.Context, job *jobs.Job, p echoPayload) error {
+		if err := job.SetProgress(50); err != nil {
+			return err
+		}
+		received <- p.Message
+		return nil
+	})
+
+	job, err := echoJob.Enqueue(database.DB.Db, echoPayload{Message: "hello"})
+	assert.NoError(t, err)
+
+	pool := jobs.NewPool(database.DB.Db, 2)
+	pool.Start()
+	defer pool.Stop(context.Background())
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "hello", msg)
+	case <-time.After(10 * time.Second):
+		t.Fatal("job was never run")
+	}
+
+	done := waitForStatus(t, job.ID, jobs.StatusSucceeded)
+	assert.Equal(t, 100, done.Progress)
+	assert.Equal(t, 1, done.Attempts)
+}
+
+func TestJobIsRetriedWithBackoff(t *testing.T) {
+	jobs.Register(flakyJob, func(ctx context.Context, job *jobs.Job, p echoPayload) error {
+		return errors.New("temporary failure")
+	})
+
+	job, err := flakyJob.Enqueue(database.DB.Db, echoPayload{})
+	assert.NoError(t, err)
+
+	pool := jobs.NewPool(database.DB.Db, 1)
+	pool.Start()
+	defer pool.Stop(context.Background())
+
+	var retried models.Job
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		database.DB.Db.First(&retried, job.ID)
+		if retried.Attempts == 1 && retried.Status == jobs.StatusQueued {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, jobs.StatusQueued, retried.Status)
+	assert.Equal(t, "temporary failure", retried.LastError)
+	assert.True(t, retried.RunAt.After(time.Now()), "retry should be scheduled in the future")
+
+	database.DB.Db.Unscoped().Delete(&models.Job{}, job.ID)
+}
+
+func TestWorkerThatLostItsLeaseLeavesTheJobAlone(t *testing.T) {
+	finished := make(chan struct{})
+	jobs.Register(stolenJob, func(ctx context.Context, job *jobs.Job, p echoPayload) error {
+		defer close(finished)
+
+		// Another worker claims the job, as if this one's lease had lapsed.
+		database.DB.Db.Model(&models.Job{}).Where("id = ?", job.ID).Update("claimed_by", "another worker")
+		return job.SetProgress(90)
+	})
+
+	job, err := stolenJob.Enqueue(database.DB.Db, echoPayload{})
+	assert.NoError(t, err)
+	defer database.DB.Db.Unscoped().Delete(&models.Job{}, job.ID)
+
+	pool := jobs.NewPool(database.DB.Db, 1)
+	pool.Start()
+
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatal("job was never run")
+	}
+	pool.Stop(context.Background())
+
+	var stored models.Job
+	database.DB.Db.First(&stored, job.ID)
+	assert.Equal(t, jobs.StatusRunning, stored.Status)
+	assert.Equal(t, "another worker", stored.ClaimedBy)
+	assert.Equal(t, 0, stored.Progress)
+}
+
+func TestJobAbandonedOnItsLastAttemptFails(t *testing.T) {
+	// A job whose worker died during its last attempt.
+	lockedAt := time.Now().Add(-time.Hour)
+	job := models.Job{
+		Type:        "test.crashing",
+		Status:      jobs.StatusRunning,
+		RunAt:       lockedAt,
+		Attempts:    5,
+		MaxAttempts: 5,
+		LockedAt:    &lockedAt,
+		ClaimedBy:   "dead worker",
+	}
+	if err := database.DB.Db.Create(&job).Error; err != nil {
+		t.Fatal("Failed to create job:", err)
+	}
+	defer database.DB.Db.Unscoped().Delete(&models.Job{}, job.ID)
+
+	pool := jobs.NewPool(database.DB.Db, 1)
+	pool.Start()
+	defer pool.Stop(context.Background())
+
+	failed := waitForStatus(t, job.ID, jobs.StatusFailed)
+	assert.Equal(t, 5, failed.Attempts)
+	assert.NotNil(t, failed.FinishedAt)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 2*time.Second, jobs.Backoff(1))
+	assert.Equal(t, 8*time.Second, jobs.Backoff(3))
+	assert.Equal(t, time.Hour, jobs.Backoff(30))
+}
@@ -0,0 +1,273 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"gorm.io/gorm"
+)
+
+const (
+	pollInterval = time.Second
+	// A job whose lease hasn't been renewed for this long is assumed to
+	// belong to a worker that died and becomes claimable again. Workers renew
+	// the lease every leaseRenewal for as long as the job runs, so jobs may
+	// run for any length of time.
+	leaseTimeout = 2 * time.Minute
+	leaseRenewal = 30 * time.Second
+	maxBackoff   = time.Hour
+)
+
+// errLeaseLost is returned when a worker finds another claim on its job,
+// after its lease lapsed. The other claim decides the job's outcome.
+var errLeaseLost = errors.New("job lease lost to another worker")
+
+// claimQuery atomically picks the next due job and marks it running. SKIP
+// LOCKED lets several workers (and several replicas) poll the same table
+// without blocking on, or double claiming, each other's rows.
+const claimQuery = `
+UPDATE jobs SET status = ?, claimed_by = ?, attempts = attempts + 1, locked_at = now(), updated_at = now()
+WHERE id = (
+	SELECT id FROM jobs
+	WHERE deleted_at IS NULL
+	  AND ((status = ? AND run_at <= now()) OR (status = ? AND locked_at < ? AND attempts < max_attempts))
+	ORDER BY run_at, id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING *`
+
+// abandonQuery fails jobs whose lease lapsed on their last attempt. A job
+// that keeps taking its worker down with it would otherwise be reclaimed
+// forever.
+const abandonQuery = `
+UPDATE jobs SET status = ?, claimed_by = '', locked_at = NULL, last_error = ?, finished_at = now(), updated_at = now()
+WHERE deleted_at IS NULL AND status = ? AND locked_at < ? AND attempts >= max_attempts`
+
+type Pool struct {
+	db      *gorm.DB
+	workers int
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewPool(db *gorm.DB, workers int) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Pool{db: db, workers: workers}
+}
+
+// Start launches the workers. They run until Stop is called.
+func (p *Pool) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work(ctx)
+	}
+
+	slog.Info("Started job workers", "workers", p.workers)
+}
+
+// Stop cancels running jobs and waits for the workers to exit, or for ctx to
+// expire, whichever comes first. Cancelled jobs are put back in the queue.
+func (p *Pool) Stop(ctx context.Context) error {
+	if p.cancel == nil {
+		return nil
+	}
+	p.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("Job workers stopped")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) work(ctx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		claimed, err := p.runNext(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Job worker error", "error", err)
+		}
+		if claimed && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// runNext claims and runs a single job. It reports whether a job was claimed.
+func (p *Pool) runNext(ctx context.Context) (bool, error) {
+	if ctx.Err() != nil {
+		return false, nil
+	}
+
+	claim, err := newClaim()
+	if err != nil {
+		return false, err
+	}
+
+	staleBefore := time.Now().Add(-leaseTimeout)
+	abandoned := p.db.Exec(abandonQuery, StatusFailed, "worker stopped while running the job", StatusRunning, staleBefore)
+	if abandoned.Error != nil {
+		return false, abandoned.Error
+	}
+	if abandoned.RowsAffected > 0 {
+		slog.Error("Jobs failed permanently after their workers stopped", "jobs", abandoned.RowsAffected)
+	}
+
+	var claimed []models.Job
+	err = p.db.Raw(claimQuery,
+		StatusRunning, claim, StatusQueued, StatusRunning, staleBefore,
+	).Scan(&claimed).Error
+	if err != nil {
+		return false, err
+	}
+	if len(claimed) == 0 {
+		return false, nil
+	}
+
+	job := &Job{Job: &claimed[0], db: p.db, claim: claim}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		p.renewLease(jobCtx, cancel, job)
+	}()
+
+	runErr := p.run(jobCtx, job)
+	cancel()
+	<-renewed
+
+	return true, p.finish(ctx, job, runErr)
+}
+
+// renewLease keeps job's lease fresh until ctx is done. If the lease turns
+// out to be lost, it cancels the job through cancel.
+func (p *Pool) renewLease(ctx context.Context, cancel context.CancelFunc, job *Job) {
+	ticker := time.NewTicker(leaseRenewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		result := p.db.Model(&models.Job{}).
+			Where("id = ? AND claimed_by = ? AND status = ?", job.ID, job.claim, StatusRunning).
+			Update("locked_at", time.Now())
+		if result.Error != nil {
+			// Try again next tick; the lease has time to spare.
+			slog.ErrorContext(ctx, "Job lease renewal error", "job_id", job.ID, "error", result.Error)
+			continue
+		}
+		if result.RowsAffected == 0 {
+			slog.Warn("Job lease lost, cancelling", "job_id", job.ID, "type", job.Type)
+			cancel()
+			return
+		}
+	}
+}
+
+func (p *Pool) run(ctx context.Context, job *Job) (err error) {
+	fn, ok := lookup(job.Type)
+	if !ok {
+		return fmt.Errorf("no handler registered for job type %q", job.Type)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return fn(ctx, job)
+}
+
+func (p *Pool) finish(ctx context.Context, job *Job, runErr error) error {
+	now := time.Now()
+	updates := map[string]interface{}{"locked_at": nil, "claimed_by": ""}
+
+	switch {
+	case runErr == nil:
+		updates["status"] = StatusSucceeded
+		updates["progress"] = 100
+		updates["last_error"] = ""
+		updates["finished_at"] = now
+
+	case ctx.Err() != nil && errors.Is(runErr, ctx.Err()):
+		// Interrupted by shutdown rather than failed: give the attempt back.
+		updates["status"] = StatusQueued
+		updates["attempts"] = gorm.Expr("attempts - 1")
+		updates["run_at"] = now
+
+	case job.Attempts >= job.MaxAttempts:
+		slog.Error("Job failed permanently", "job_id", job.ID, "type", job.Type, "error", runErr)
+		updates["status"] = StatusFailed
+		updates["last_error"] = runErr.Error()
+		updates["finished_at"] = now
+
+	default:
+		slog.Warn("Job failed, retrying", "job_id", job.ID, "type", job.Type, "error", runErr)
+		updates["status"] = StatusQueued
+		updates["last_error"] = runErr.Error()
+		updates["run_at"] = now.Add(Backoff(job.Attempts))
+	}
+
+	result := p.db.Model(&models.Job{}).Where("id = ? AND claimed_by = ?", job.ID, job.claim).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("job %d: %w", job.ID, errLeaseLost)
+	}
+	return nil
+}
+
+func newClaim() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Backoff returns how long to wait before retrying after the given number of
+// attempts: 2s, 4s, 8s, ... capped at an hour.
+func Backoff(attempts int) time.Duration {
+	d := time.Duration(math.Pow(2, float64(attempts))) * time.Second
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
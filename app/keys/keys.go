@@ -0,0 +1,192 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+// Key is one JWT key, identified by the kid header of the tokens it signs.
+// Each key is bound to a single algorithm; a token naming a different
+// algorithm is rejected even if the signature would verify.
+type Key struct {
+	ID        string
+	Algorithm string
+
+	private interface{} // nil for verify-only keys kept around after rotation
+	public  interface{}
+}
+
+func NewHMACKey(kid string, secret []byte) *Key {
+	return &Key{ID: kid, Algorithm: HS256, private: secret, public: secret}
+}
+
+func NewRSAKey(kid string, private *rsa.PrivateKey) *Key {
+	return &Key{ID: kid, Algorithm: RS256, private: private, public: &private.PublicKey}
+}
+
+func NewRSAPublicKey(kid string, public *rsa.PublicKey) *Key {
+	return &Key{ID: kid, Algorithm: RS256, public: public}
+}
+
+func NewEd25519Key(kid string, private ed25519.PrivateKey) *Key {
+	return &Key{ID: kid, Algorithm: EdDSA, private: private, public: private.Public()}
+}
+
+func NewEd25519PublicKey(kid string, public ed25519.PublicKey) *Key {
+	return &Key{ID: kid, Algorithm: EdDSA, public: public}
+}
+
+func (k *Key) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// Manager signs tokens with the current signing key and verifies tokens
+// signed by any key it holds, so keys can be rotated by adding a new key,
+// switching the signing kid, and removing the old key once its tokens have
+// expired.
+type Manager struct {
+	issuer   string
+	audience string
+	keys     map[string]*Key
+	signing  *Key
+	parser   *jwt.Parser
+}
+
+func NewManager(issuer, audience, signingKID string, keys ...*Key) (*Manager, error) {
+	m := &Manager{
+		issuer:   issuer,
+		audience: audience,
+		keys:     map[string]*Key{},
+	}
+
+	algorithms := map[string]bool{}
+	for _, key := range keys {
+		if key.method() == nil {
+			return nil, fmt.Errorf("key %q: unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+		if _, dup := m.keys[key.ID]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		m.keys[key.ID] = key
+		algorithms[key.Algorithm] = true
+	}
+
+	m.signing = m.keys[signingKID]
+	if m.signing == nil {
+		return nil, fmt.Errorf("signing key %q not found", signingKID)
+	}
+	if m.signing.private == nil {
+		return nil, fmt.Errorf("signing key %q has no private key", signingKID)
+	}
+
+	valid := []string{}
+	for alg := range algorithms {
+		valid = append(valid, alg)
+	}
+
+	m.parser = jwt.NewParser(
+		jwt.WithValidMethods(valid),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(30*time.Second),
+	)
+
+	return m, nil
+}
+
+// Sign adds the iss, aud and iat claims and signs with the current key.
+func (m *Manager) Sign(claims jwt.MapClaims) (string, error) {
+	claims["iss"] = m.issuer
+	claims["aud"] = m.audience
+	if _, ok := claims["iat"]; !ok {
+		claims["iat"] = time.Now().Unix()
+	}
+
+	token := jwt.NewWithClaims(m.signing.method(), claims)
+	token.Header["kid"] = m.signing.ID
+
+	return token.SignedString(m.signing.private)
+}
+
+// Parse verifies a token's signature, algorithm, issuer, audience and
+// expiry. Tokens without a known kid are rejected.
+func (m *Manager) Parse(tokenString string) (*jwt.Token, error) {
+	return m.parser.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		key, ok := m.keys[kid]
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		// Pin the algorithm to the key, so an RSA public key can never be
+		// used as an HMAC secret.
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+		}
+		return key.public, nil
+	})
+}
+
+// JWK is a public key in RFC 7517 format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every asymmetric key. HMAC secrets are
+// never published.
+func (m *Manager) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+
+	for _, key := range m.keys {
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Alg: key.Algorithm,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Alg: key.Algorithm,
+				Use: "sig",
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(public),
+			})
+		}
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
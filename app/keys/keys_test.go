@@ -0,0 +1,161 @@
+package keys_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": "keys@grahamsummitllc.com",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestSignAndParseEachAlgorithm(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	all := []*keys.Key{
+		keys.NewHMACKey("hmac", []byte("secret")),
+		keys.NewRSAKey("rsa", rsaKey),
+		keys.NewEd25519Key("ed", edKey),
+	}
+
+	for _, signing := range []string{"hmac", "rsa", "ed"} {
+		m, err := keys.NewManager("issuer", "audience", signing, all...)
+		assert.NoError(t, err)
+
+		tokenString, err := m.Sign(claims())
+		assert.NoError(t, err)
+
+		token, err := m.Parse(tokenString)
+		if assert.NoError(t, err, signing) {
+			assert.Equal(t, signing, token.Header["kid"])
+		}
+	}
+}
+
+func TestRotationKeepsOldTokensValid(t *testing.T) {
+	old := keys.NewHMACKey("2024", []byte("old secret"))
+	current := keys.NewHMACKey("2025", []byte("new secret"))
+
+	before, err := keys.NewManager("issuer", "audience", "2024", old)
+	assert.NoError(t, err)
+	tokenString, err := before.Sign(claims())
+	assert.NoError(t, err)
+
+	after, err := keys.NewManager("issuer", "audience", "2025", old, current)
+	assert.NoError(t, err)
+	_, err = after.Parse(tokenString)
+	assert.NoError(t, err)
+
+	retired, err := keys.NewManager("issuer", "audience", "2025", current)
+	assert.NoError(t, err)
+	_, err = retired.Parse(tokenString)
+	assert.Error(t, err)
+}
+
+func TestParseRejects(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	m, err := keys.NewManager("issuer", "audience", "hmac",
+		keys.NewHMACKey("hmac", []byte("secret")),
+		keys.NewRSAPublicKey("rsa", &rsaKey.PublicKey),
+	)
+	assert.NoError(t, err)
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, c jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, c)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		s, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return s
+	}
+
+	valid := func() jwt.MapClaims {
+		c := claims()
+		c["iss"] = "issuer"
+		c["aud"] = "audience"
+		return c
+	}
+
+	// Algorithm confusion: HS256 signed with the RSA public key as secret.
+	publicDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	_, err = m.Parse(sign(jwt.SigningMethodHS256, "rsa", publicPEM, valid()))
+	assert.Error(t, err, "algorithm confusion")
+
+	_, err = m.Parse(sign(jwt.SigningMethodHS256, "", []byte("secret"), valid()))
+	assert.Error(t, err, "missing kid")
+
+	wrongIssuer := valid()
+	wrongIssuer["iss"] = "someone-else"
+	_, err = m.Parse(sign(jwt.SigningMethodHS256, "hmac", []byte("secret"), wrongIssuer))
+	assert.Error(t, err, "wrong issuer")
+
+	wrongAudience := valid()
+	wrongAudience["aud"] = "another-api"
+	_, err = m.Parse(sign(jwt.SigningMethodHS256, "hmac", []byte("secret"), wrongAudience))
+	assert.Error(t, err, "wrong audience")
+
+	noExpiry := valid()
+	delete(noExpiry, "exp")
+	_, err = m.Parse(sign(jwt.SigningMethodHS256, "hmac", []byte("secret"), noExpiry))
+	assert.Error(t, err, "missing exp")
+
+	_, err = m.Parse(sign(jwt.SigningMethodHS256, "hmac", []byte("secret"), valid()))
+	assert.NoError(t, err)
+}
+
+func TestJWKSPublishesOnlyPublicKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	m, err := keys.NewManager("issuer", "audience", "hmac",
+		keys.NewHMACKey("hmac", []byte("secret")),
+		keys.NewRSAKey("rsa", rsaKey),
+		keys.NewEd25519PublicKey("ed", edPublic),
+	)
+	assert.NoError(t, err)
+
+	set := m.JWKS()
+	if assert.Len(t, set.Keys, 2) {
+		assert.Equal(t, "ed", set.Keys[0].Kid)
+		assert.Equal(t, "OKP", set.Keys[0].Kty)
+		assert.Equal(t, "rsa", set.Keys[1].Kid)
+		assert.Equal(t, "RSA", set.Keys[1].Kty)
+		assert.Equal(t, "AQAB", set.Keys[1].E)
+	}
+}
+
+func TestLoadDefault(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("BCRYPT_KEY", "")
+	t.Setenv("JWT_KEYS_DIR", "")
+	assert.Error(t, keys.LoadDefault())
+
+	t.Setenv("JWT_SECRET", "test-secret")
+	assert.NoError(t, keys.LoadDefault())
+
+	token, err := keys.Default().Sign(claims())
+	assert.NoError(t, err)
+	_, err = keys.Default().Parse(token)
+	assert.NoError(t, err)
+}
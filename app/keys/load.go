@@ -0,0 +1,206 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+var defaultManager atomic.Pointer[Manager]
+
+// LoadDefault loads the keys from the environment (see LoadFromEnv) and
+// makes them the process wide manager. main calls it at startup, so a bad
+// key configuration stops the server before it serves a request.
+func LoadDefault() error {
+	m, err := LoadFromEnv()
+	if err != nil {
+		return err
+	}
+	SetDefault(m)
+	return nil
+}
+
+// SetDefault makes m the process wide key manager.
+func SetDefault(m *Manager) {
+	defaultManager.Store(m)
+}
+
+// Default returns the process wide key manager. It panics if neither
+// LoadDefault nor SetDefault was called.
+func Default() *Manager {
+	m := defaultManager.Load()
+	if m == nil {
+		panic("keys: no default manager; call keys.LoadDefault at startup")
+	}
+	return m
+}
+
+// LoadFromEnv builds a Manager from:
+//
+//	JWT_ISSUER, JWT_AUDIENCE  claims required on every token (default "go_api_ds")
+//	JWT_SECRET                HS256 secret, registered under kid "default"
+//	JWT_KEYS_DIR              directory of key files named <kid>.<alg>[.pem]:
+//	                            <kid>.hs256      raw HMAC secret
+//	                            <kid>.rs256.pem  RSA private key, or public key to only verify
+//	                            <kid>.eddsa.pem  Ed25519 private key, or public key to only verify
+//	JWT_SIGNING_KID           kid used to sign new tokens (default "default")
+//
+// BCRYPT_KEY, the variable that used to hold the HMAC secret, is still read
+// when JWT_SECRET is unset.
+func LoadFromEnv() (*Manager, error) {
+	issuer := envOr("JWT_ISSUER", "go_api_ds")
+	audience := envOr("JWT_AUDIENCE", "go_api_ds")
+	signingKID := envOr("JWT_SIGNING_KID", "default")
+
+	keys := []*Key{}
+
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" && os.Getenv("BCRYPT_KEY") != "" {
+		slog.Warn("BCRYPT_KEY is deprecated for signing tokens; rename it to JWT_SECRET")
+		secret = os.Getenv("BCRYPT_KEY")
+	}
+	if secret != "" {
+		keys = append(keys, NewHMACKey("default", []byte(secret)))
+	}
+
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		loaded, err := loadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, loaded...)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no JWT keys configured; set JWT_SECRET or JWT_KEYS_DIR")
+	}
+
+	return NewManager(issuer, audience, signingKID, keys...)
+}
+
+func loadDir(dir string) ([]*Key, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*Key{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := entry.Name()
+		parts := strings.Split(strings.TrimSuffix(name, ".pem"), ".")
+		if len(parts) != 2 {
+			continue
+		}
+		kid, alg := parts[0], strings.ToLower(parts[1])
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		var key *Key
+		switch alg {
+		case "hs256":
+			key = NewHMACKey(kid, []byte(strings.TrimSpace(string(data))))
+		case "rs256":
+			key, err = parseRSA(kid, data)
+		case "eddsa":
+			key, err = parseEd25519(kid, data)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func parseRSA(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewRSAKey(kid, private), nil
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an RSA private key")
+		}
+		return NewRSAKey(kid, private), nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := parsed.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA public key")
+		}
+		return NewRSAPublicKey(kid, public), nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func parseEd25519(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 private key")
+		}
+		return NewEd25519Key(kid, private), nil
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("not an Ed25519 public key")
+		}
+		return NewEd25519PublicKey(kid, public), nil
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
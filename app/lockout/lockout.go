@@ -0,0 +1,161 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/config"
+	"github.com/go-redis/redis/v8"
+)
+
+// Failed logins are counted in Redis per account and per client IP. The
+// first few failures are free; after that each attempt has to wait twice
+// as long as the previous one, and once the limit is reached the account
+// (or IP) is locked out until the counter expires.
+//
+// Counters are kept for unknown emails too, so a locked response does not
+// reveal whether an account exists.
+
+const freeAttempts = 3
+
+// Policy is read from the environment on every call so tests and operators
+// can change it without a restart.
+type Policy struct {
+	MaxAccountFailures int           // LOGIN_MAX_FAILURES, default 5
+	MaxIPFailures      int           // LOGIN_MAX_IP_FAILURES, default 50
+	Lockout            time.Duration // LOGIN_LOCKOUT, default 15m
+}
+
+func CurrentPolicy() Policy {
+	return Policy{
+		MaxAccountFailures: config.Int("LOGIN_MAX_FAILURES", 5),
+		MaxIPFailures:      config.Int("LOGIN_MAX_IP_FAILURES", 50),
+		Lockout:            config.Duration("LOGIN_LOCKOUT", 15*time.Minute),
+	}
+}
+
+func accountKey(email string) string {
+	return "auth:failures:account:" + email
+}
+
+func ipKey(ip string) string {
+	return "auth:failures:ip:" + ip
+}
+
+// maxReserveTries bounds how often Reserve retries when another login
+// changes the counters between its read and its write.
+const maxReserveTries = 20
+
+// Reserve counts a login attempt to email from ip before the credentials are
+// checked. If the client has to wait first, it returns how long and counts
+// nothing. The check and the count are one atomic step, so parallel guesses
+// can't all get through before the first failure is recorded. Call Succeed
+// if the attempt turns out to be good.
+func Reserve(ctx context.Context, rdb *redis.Client, email, ip string) (time.Duration, error) {
+	policy := CurrentPolicy()
+	account, byIP := accountKey(email), ipKey(ip)
+
+	var remaining time.Duration
+	reserve := func(tx *redis.Tx) error {
+		accountWait, err := wait(ctx, tx, account, policy.MaxAccountFailures, policy.Lockout)
+		if err != nil {
+			return err
+		}
+		ipWait, err := wait(ctx, tx, byIP, policy.MaxIPFailures, policy.Lockout)
+		if err != nil {
+			return err
+		}
+
+		remaining = max(accountWait, ipWait)
+		if remaining > 0 {
+			return nil
+		}
+
+		now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range []string{account, byIP} {
+				pipe.HIncrBy(ctx, key, "count", 1)
+				pipe.HSet(ctx, key, "last", now)
+				pipe.Expire(ctx, key, policy.Lockout)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxReserveTries; i++ {
+		err := rdb.Watch(ctx, reserve, account, byIP)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return remaining, err
+		}
+	}
+	return 0, redis.TxFailedErr
+}
+
+// releaseScript takes one attempt back off a counter, unless it has
+// expired in the meantime.
+var releaseScript = redis.NewScript(`
+if tonumber(redis.call("HGET", KEYS[1], "count") or "0") > 0 then
+	redis.call("HINCRBY", KEYS[1], "count", -1)
+end
+return 0`)
+
+// Succeed settles an attempt reserved with Reserve that turned out to be
+// good: the account counter is cleared and the attempt is taken back off
+// the IP counter.
+func Succeed(ctx context.Context, rdb *redis.Client, email, ip string) error {
+	if err := Reset(ctx, rdb, email); err != nil {
+		return err
+	}
+	return releaseScript.Run(ctx, rdb, []string{ipKey(ip)}).Err()
+}
+
+// Reset clears the account counter after a successful login. The IP counter
+// is left alone, otherwise one valid account would let an attacker keep
+// guessing at others from the same address.
+func Reset(ctx context.Context, rdb *redis.Client, email string) error {
+	return rdb.Del(ctx, accountKey(email)).Err()
+}
+
+func wait(ctx context.Context, rdb redis.Cmdable, key string, max int, lockout time.Duration) (time.Duration, error) {
+	values, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	count, _ := strconv.Atoi(values["count"])
+	lastMillis, _ := strconv.ParseInt(values["last"], 10, 64)
+	if count <= freeAttempts && count < max {
+		return 0, nil
+	}
+
+	delay := lockout
+	if count < max {
+		delay = Delay(count)
+		if delay > lockout {
+			delay = lockout
+		}
+	}
+
+	remaining := time.Until(time.UnixMilli(lastMillis).Add(delay))
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
+// Delay is how long to wait after the given number of consecutive failures
+// before the account is locked: 1s after the first failure past the free
+// ones, then 2s, 4s and so on.
+func Delay(failures int) time.Duration {
+	if failures <= freeAttempts {
+		return 0
+	}
+	n := failures - freeAttempts - 1
+	if n > 20 {
+		n = 20
+	}
+	return time.Second << n
+}
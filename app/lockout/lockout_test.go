@@ -0,0 +1,17 @@
+package lockout_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/lockout"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelay(t *testing.T) {
+	assert.Equal(t, time.Duration(0), lockout.Delay(0))
+	assert.Equal(t, time.Duration(0), lockout.Delay(3))
+	assert.Equal(t, time.Second, lockout.Delay(4))
+	assert.Equal(t, 2*time.Second, lockout.Delay(5))
+	assert.Equal(t, 8*time.Second, lockout.Delay(7))
+}
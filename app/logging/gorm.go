@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// SlowQuery is how long a query may take before it is logged as a warning.
+const SlowQuery = 200 * time.Millisecond
+
+// GORM feeds GORM's logs to slog: failed queries as errors, slow ones as
+// warnings and the rest at debug, so SQL is only printed with
+// LOG_LEVEL=debug. A missing record is not an error.
+type GORM struct {
+	level logger.LogLevel
+}
+
+func NewGORM() *GORM {
+	return &GORM{level: logger.Info}
+}
+
+func (g *GORM) LogMode(level logger.LogLevel) logger.Interface {
+	return &GORM{level: level}
+}
+
+func (g *GORM) Info(ctx context.Context, msg string, data ...interface{}) {
+	if g.level >= logger.Info {
+		slog.InfoContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+func (g *GORM) Warn(ctx context.Context, msg string, data ...interface{}) {
+	if g.level >= logger.Warn {
+		slog.WarnContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+func (g *GORM) Error(ctx context.Context, msg string, data ...interface{}) {
+	if g.level >= logger.Error {
+		slog.ErrorContext(ctx, fmt.Sprintf(msg, data...))
+	}
+}
+
+func (g *GORM) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if g.level <= logger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+
+	var (
+		level slog.Level
+		msg   string
+	)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && g.level >= logger.Error:
+		level, msg = slog.LevelError, "SQL query failed"
+	case elapsed > SlowQuery && g.level >= logger.Warn:
+		level, msg = slog.LevelWarn, "Slow SQL query"
+	case g.level >= logger.Info:
+		level, msg = slog.LevelDebug, "SQL query"
+	default:
+		return
+	}
+
+	// Don't render the SQL for records that would be dropped.
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+
+	sql, rows := fc()
+	attrs := []any{
+		slog.String("sql", sql),
+		slog.Int64("rows", rows),
+		slog.Float64("duration_ms", float64(elapsed)/float64(time.Millisecond)),
+	}
+	if level == slog.LevelError {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	slog.Log(ctx, level, msg, attrs...)
+}
@@ -0,0 +1,71 @@
+// Package logging configures log/slog for the application: JSON to stdout,
+// at the level in LOG_LEVEL, with the request ID of the context, if any, on
+// every record.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Setup makes a JSON handler the default for slog and for the log package.
+// LOG_LEVEL is one of debug, info (the default), warn or error.
+func Setup() {
+	slog.SetDefault(slog.New(NewHandler(os.Stdout, Level())))
+}
+
+// Level reads LOG_LEVEL, falling back to info when it is unset or invalid.
+func Level() slog.Level {
+	value := os.Getenv("LOG_LEVEL")
+	if value == "" {
+		return slog.LevelInfo
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		slog.Warn("Invalid LOG_LEVEL, using info", "value", value)
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// NewHandler is a JSON handler writing to w, which adds the request ID.
+func NewHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})}
+}
+
+type contextKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id. Records
+// logged with the context, e.g. by slog.ErrorContext, include it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// RequestID is the request ID in ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
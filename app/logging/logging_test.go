@@ -0,0 +1,100 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/logging"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// capture sends the default logger to a buffer for the rest of the test.
+func capture(t *testing.T, level slog.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(logging.NewHandler(&buf, level)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func records(buf *bytes.Buffer) []map[string]interface{} {
+	var out []map[string]interface{}
+	decoder := json.NewDecoder(buf)
+	for decoder.More() {
+		var record map[string]interface{}
+		if decoder.Decode(&record) != nil {
+			break
+		}
+		out = append(out, record)
+	}
+	return out
+}
+
+func TestLevel(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "")
+	assert.Equal(t, slog.LevelInfo, logging.Level())
+
+	t.Setenv("LOG_LEVEL", "debug")
+	assert.Equal(t, slog.LevelDebug, logging.Level())
+
+	t.Setenv("LOG_LEVEL", "WARN")
+	assert.Equal(t, slog.LevelWarn, logging.Level())
+
+	t.Setenv("LOG_LEVEL", "loud")
+	assert.Equal(t, slog.LevelInfo, logging.Level())
+}
+
+func TestRequestIDIsLogged(t *testing.T) {
+	buf := capture(t, slog.LevelInfo)
+
+	ctx := logging.WithRequestID(context.Background(), "abc123")
+	slog.InfoContext(ctx, "With ID")
+	slog.Info("Without ID")
+	slog.DebugContext(ctx, "Too quiet")
+
+	logged := records(buf)
+	if assert.Len(t, logged, 2) {
+		assert.Equal(t, "With ID", logged[0]["msg"])
+		assert.Equal(t, "abc123", logged[0]["request_id"])
+		assert.NotContains(t, logged[1], "request_id")
+	}
+}
+
+func TestGORM(t *testing.T) {
+	buf := capture(t, slog.LevelInfo)
+	g := logging.NewGORM()
+	ctx := context.Background()
+
+	query := func(sql string) func() (string, int64) {
+		return func() (string, int64) { return sql, 1 }
+	}
+
+	// Ordinary queries are debug, so not logged at info.
+	g.Trace(ctx, time.Now(), query("SELECT 1"), nil)
+	// Neither is a missing record.
+	g.Trace(ctx, time.Now(), query("SELECT 2"), gorm.ErrRecordNotFound)
+	g.Trace(ctx, time.Now(), query("SELECT 3"), errors.New("syntax error"))
+	g.Trace(ctx, time.Now().Add(-time.Second), query("SELECT 4"), nil)
+
+	logged := records(buf)
+	if assert.Len(t, logged, 2) {
+		assert.Equal(t, "ERROR", logged[0]["level"])
+		assert.Equal(t, "SELECT 3", logged[0]["sql"])
+		assert.Equal(t, "syntax error", logged[0]["error"])
+		assert.Equal(t, "WARN", logged[1]["level"])
+		assert.Equal(t, "SELECT 4", logged[1]["sql"])
+	}
+
+	buf = capture(t, slog.LevelDebug)
+	g.Trace(ctx, time.Now(), query("SELECT 1"), nil)
+	logged = records(buf)
+	if assert.Len(t, logged, 1) {
+		assert.Equal(t, "SELECT 1", logged[0]["sql"])
+	}
+}
@@ -0,0 +1,44 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileMailer writes each message to its own file in Dir, named after the
+// time it was sent and the recipient, for development and tests.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), safeName(msg.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), format(From(), msg), 0o600)
+}
+
+func safeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// LogMailer writes messages to the log instead of sending them. It is the
+// fallback when no mailer is configured, outside production.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "Mail", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
@@ -0,0 +1,117 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/capgainschristian/go_api_ds/config"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email. Handlers only depend on this interface, so production
+// can use SMTP while development and tests write messages locally.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var (
+	defaultMu     sync.Mutex
+	defaultMailer Mailer
+)
+
+// Default returns the process wide mailer, picking one from the environment
+// with FromEnv on first use if LoadDefault wasn't called. If none can be
+// picked, every Send fails.
+func Default() Mailer {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if defaultMailer == nil {
+		m, err := FromEnv()
+		if err != nil {
+			m = failingMailer{err: err}
+		}
+		defaultMailer = m
+	}
+	return defaultMailer
+}
+
+// LoadDefault picks the process wide mailer from the environment. main calls
+// it at startup, so a server that can't send mail refuses to start.
+func LoadDefault() error {
+	m, err := FromEnv()
+	if err != nil {
+		return err
+	}
+	SetDefault(m)
+	return nil
+}
+
+// SetDefault replaces the process wide mailer, for tests.
+func SetDefault(m Mailer) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultMailer = m
+}
+
+// FromEnv picks a mailer from the environment:
+//
+//	SMTP_ADDR  host:port of an SMTP server; also reads SMTP_USERNAME,
+//	           SMTP_PASSWORD and MAIL_FROM
+//	MAIL_DIR   directory to write each message to as a file
+//
+// With neither set, messages are written to the log, except in production
+// where that would leak password reset tokens and verification links into
+// the logs; there it is an error.
+func FromEnv() (Mailer, error) {
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return &SMTPMailer{
+			Addr:     addr,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     From(),
+		}, nil
+	}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		return &FileMailer{Dir: dir}, nil
+	}
+	if config.IsProduction() {
+		return nil, errors.New("no mail transport configured; set SMTP_ADDR")
+	}
+	return LogMailer{}, nil
+}
+
+// failingMailer refuses to send, for when no mailer could be picked.
+type failingMailer struct {
+	err error
+}
+
+func (m failingMailer) Send(ctx context.Context, msg Message) error {
+	return m.err
+}
+
+// From is the sender address, MAIL_FROM.
+func From() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "no-reply@localhost"
+}
+
+// AppURL is where users reach the API, APP_URL, used to build links in
+// messages.
+func AppURL() string {
+	if url := os.Getenv("APP_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:3000"
+}
@@ -0,0 +1,62 @@
+package mail_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/capgainschristian/go_api_ds/mail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	m := &mail.FileMailer{Dir: dir}
+
+	err := m.Send(context.Background(), mail.Message{
+		To:      "files@grahamsummitllc.com",
+		Subject: "Hello",
+		Body:    "First line\nSecond line\n",
+	})
+	assert.NoError(t, err)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	data, _ := os.ReadFile(files[0])
+	assert.Contains(t, string(data), "To: files@grahamsummitllc.com\r\n")
+	assert.Contains(t, string(data), "Subject: Hello\r\n")
+	assert.Contains(t, string(data), "\r\n\r\nFirst line\r\nSecond line\r\n")
+}
+
+func TestFromEnv(t *testing.T) {
+	mailer := func() mail.Mailer {
+		t.Helper()
+		m, err := mail.FromEnv()
+		assert.NoError(t, err)
+		return m
+	}
+
+	t.Setenv("APP_ENV", "development")
+	t.Setenv("SMTP_ADDR", "")
+	t.Setenv("MAIL_DIR", "")
+	assert.IsType(t, mail.LogMailer{}, mailer())
+
+	// Production never logs messages, which carry reset tokens.
+	t.Setenv("APP_ENV", "production")
+	_, err := mail.FromEnv()
+	assert.Error(t, err)
+
+	// Nor does a deployment that never set APP_ENV.
+	t.Setenv("APP_ENV", "")
+	_, err = mail.FromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("MAIL_DIR", t.TempDir())
+	assert.IsType(t, &mail.FileMailer{}, mailer())
+
+	t.Setenv("SMTP_ADDR", "smtp.grahamsummitllc.com:587")
+	assert.IsType(t, &mail.SMTPMailer{}, mailer())
+}
@@ -0,0 +1,160 @@
+// Package metrics exposes the API's Prometheus metrics on /metrics: HTTP
+// traffic per route, the customer list cache, the database and Redis
+// connection pools, bcrypt timing and a few business gauges.
+package metrics
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "go_api_ds"
+
+// Registry holds every metric of the application, plus the Go runtime and
+// process collectors.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method and route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// CustomerCache counts the Redis lookups of ListCustomers by result:
+	// hit, miss or error.
+	CustomerCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "customer_cache_lookups_total",
+		Help:      "Customer list cache lookups by result (hit, miss, error).",
+	}, []string{"result"})
+
+	// Bcrypt times password hashing ("hash") and checking ("compare").
+	Bcrypt = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bcrypt_duration_seconds",
+		Help:      "Time spent hashing and comparing passwords with bcrypt.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		CustomerCache,
+		Bcrypt,
+	)
+}
+
+// ObserveBcrypt records how long a bcrypt operation that started at start
+// took.
+func ObserveBcrypt(operation string, start time.Time) {
+	Bcrypt.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// RegisterStores adds the metrics read from PostgreSQL and Redis at scrape
+// time. It must be called once, after both are connected.
+func RegisterStores() error {
+	sqlDB, err := database.DB.Db.DB()
+	if err != nil {
+		return err
+	}
+
+	count := &customerCount{maxAge: customerCountMaxAge}
+	customers := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "customers",
+		Help:      "Customers in the database, across all organizations.",
+	}, count.get)
+
+	return registerAll(
+		collectors.NewDBStatsCollector(sqlDB, "postgres"),
+		redisPoolCollector{cache.RedisClient.Client},
+		customers,
+	)
+}
+
+// How long the customers gauge reuses a count, so frequent or hostile scrapes
+// don't each scan the customers table.
+const customerCountMaxAge = time.Minute
+
+// customerCount caches the number of customers for up to maxAge.
+type customerCount struct {
+	maxAge time.Duration
+
+	mu        sync.Mutex
+	value     float64
+	countedAt time.Time
+}
+
+func (c *customerCount) get() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.countedAt.IsZero() && time.Since(c.countedAt) < c.maxAge {
+		return c.value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var count int64
+	if err := database.DB.Db.WithContext(ctx).Model(&models.Customer{}).Count(&count).Error; err != nil {
+		slog.Error("Failed to count customers for metrics", "error", err)
+		return math.NaN()
+	}
+
+	c.value = float64(count)
+	c.countedAt = time.Now()
+	return c.value
+}
+
+func registerAll(collectors ...prometheus.Collector) error {
+	for _, c := range collectors {
+		if err := Registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registry. If METRICS_TOKEN is set, scrapers must send
+// it as a bearer token; cmd/main.go refuses to start in production without
+// it.
+func Handler() http.Handler {
+	metrics := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := os.Getenv("METRICS_TOKEN"); token != "" {
+			got := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "Invalid metrics token", http.StatusUnauthorized)
+				return
+			}
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,44 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHandler(t *testing.T) {
+	metrics.HTTPRequests.WithLabelValues("GET", "/customers/{id:[0-9]+}/history", "200").Inc()
+
+	rr := scrape("")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `go_api_ds_http_requests_total{method="GET",route="/customers/{id:[0-9]+}/history",status="200"}`)
+	assert.Contains(t, rr.Body.String(), "go_goroutines")
+
+	t.Setenv("METRICS_TOKEN", "scrape-me")
+	assert.Equal(t, http.StatusUnauthorized, scrape("").Code)
+	assert.Equal(t, http.StatusUnauthorized, scrape("wrong").Code)
+	assert.Equal(t, http.StatusOK, scrape("scrape-me").Code)
+}
+
+func TestObserveBcrypt(t *testing.T) {
+	metrics.ObserveBcrypt("compare", time.Now().Add(-100*time.Millisecond))
+
+	body := scrape("").Body.String()
+	assert.Contains(t, body, `go_api_ds_bcrypt_duration_seconds_bucket{operation="compare",le="0.1"}`)
+	assert.Contains(t, body, `go_api_ds_bcrypt_duration_seconds_count{operation="compare"}`)
+}
@@ -0,0 +1,59 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ChallengeType is the typ claim of the token Login returns when a second
+// factor is needed. AuthMiddleware refuses these tokens, so they are only
+// good for finishing the login at /login/mfa.
+const ChallengeType = "mfa_challenge"
+
+// ChallengeTTL is how long the user has to enter their code.
+const ChallengeTTL = 5 * time.Minute
+
+var ErrInvalidChallenge = errors.New("Invalid or expired MFA token")
+
+// IssueChallenge returns a short-lived token proving that email passed the
+// password check.
+func IssueChallenge(email string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ChallengeTTL)
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", time.Time{}, err
+	}
+
+	token, err := keys.Default().Sign(jwt.MapClaims{
+		"sub": email,
+		"typ": ChallengeType,
+		"exp": expiresAt.Unix(),
+		"jti": hex.EncodeToString(jti),
+	})
+	return token, expiresAt, err
+}
+
+// ParseChallenge returns the email a challenge token was issued to.
+func ParseChallenge(tokenString string) (string, error) {
+	token, err := keys.Default().Parse(tokenString)
+	if err != nil || !token.Valid {
+		return "", ErrInvalidChallenge
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if typ, _ := claims["typ"].(string); typ != ChallengeType {
+		return "", ErrInvalidChallenge
+	}
+
+	email, _ := claims.GetSubject()
+	if email == "" {
+		return "", ErrInvalidChallenge
+	}
+	return email, nil
+}
@@ -0,0 +1,72 @@
+package mfa_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/mfa"
+	"github.com/stretchr/testify/assert"
+)
+
+// The SHA-1 secret from the RFC 6238 test vectors, base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	// The RFC lists 8 digit codes; ours are their last 6 digits.
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		code, err := mfa.Code(rfcSecret, mfa.Step(time.Unix(unix, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+
+	step, ok := mfa.Validate(rfcSecret, "081804", now)
+	assert.True(t, ok)
+	assert.Equal(t, mfa.Step(now), step)
+
+	// One step of clock drift either way is tolerated, two is not.
+	_, ok = mfa.Validate(rfcSecret, "081804", now.Add(mfa.Period*time.Second))
+	assert.True(t, ok)
+	_, ok = mfa.Validate(rfcSecret, "081804", now.Add(2*mfa.Period*time.Second))
+	assert.False(t, ok)
+
+	_, ok = mfa.Validate(rfcSecret, "081805", now)
+	assert.False(t, ok)
+	_, ok = mfa.Validate(rfcSecret, "", now)
+	assert.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	uri := mfa.URI("go_api_ds", "alexander.graham@grahamsummitllc.com", rfcSecret)
+
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/go_api_ds:alexander.graham@grahamsummitllc.com?"))
+	assert.Contains(t, uri, "secret="+rfcSecret)
+	assert.Contains(t, uri, "issuer=go_api_ds")
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := mfa.GenerateRecoveryCodes(mfa.RecoveryCodeCount)
+	assert.NoError(t, err)
+	assert.Len(t, codes, mfa.RecoveryCodeCount)
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		assert.Len(t, code, 11)
+		assert.False(t, seen[code])
+		seen[code] = true
+	}
+
+	// Case and separators don't matter.
+	assert.Equal(t, mfa.HashRecoveryCode("abcde-fghij"), mfa.HashRecoveryCode("ABCDE FGHIJ"))
+}
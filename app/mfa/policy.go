@@ -0,0 +1,82 @@
+package mfa
+
+import (
+	"sync"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"gorm.io/gorm"
+)
+
+// The roles that must use 2FA are checked on every protected request, so
+// they are cached in memory for a short while. Changes made through
+// SetRequiredRoles apply immediately on this instance and within
+// policyCacheTTL on others.
+const policyCacheTTL = 30 * time.Second
+
+var (
+	policyMu      sync.Mutex
+	policyRoles   map[string]bool
+	policyExpires time.Time
+)
+
+// RequiredRoles lists the roles whose users must use 2FA.
+func RequiredRoles(db *gorm.DB) ([]string, error) {
+	requirements := []models.MFARequirement{}
+	if err := db.Order("role").Find(&requirements).Error; err != nil {
+		return nil, err
+	}
+
+	roles := make([]string, 0, len(requirements))
+	for _, requirement := range requirements {
+		roles = append(roles, requirement.Role)
+	}
+	return roles, nil
+}
+
+// SetRequiredRoles replaces the roles whose users must use 2FA.
+func SetRequiredRoles(db *gorm.DB, roles []string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&models.MFARequirement{}).Error; err != nil {
+			return err
+		}
+		for _, role := range roles {
+			if err := tx.Create(&models.MFARequirement{Role: role}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	policyMu.Lock()
+	policyExpires = time.Time{}
+	policyMu.Unlock()
+
+	return err
+}
+
+// RequiredFor reports whether any of roles must use 2FA.
+func RequiredFor(db *gorm.DB, roles []string) (bool, error) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+
+	if time.Now().After(policyExpires) {
+		required, err := RequiredRoles(db)
+		if err != nil {
+			return false, err
+		}
+
+		policyRoles = map[string]bool{}
+		for _, role := range required {
+			policyRoles[role] = true
+		}
+		policyExpires = time.Now().Add(policyCacheTTL)
+	}
+
+	for _, role := range roles {
+		if policyRoles[role] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,40 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+)
+
+// RecoveryCodeCount is how many recovery codes are issued when 2FA is
+// enabled. Each one can be used once instead of a TOTP code.
+const RecoveryCodeCount = 10
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes returns n codes formatted like "abcde-fghij".
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := recoveryEncoding.EncodeToString(b)[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode returns the stored form of a recovery code. The codes
+// are random enough that a plain SHA-256 is sufficient; case, spaces and
+// dashes are ignored so codes can be typed loosely.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(code)
+	normalized = strings.NewReplacer("-", "", " ", "").Replace(normalized)
+
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
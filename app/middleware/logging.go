@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/logging"
+	"github.com/gorilla/mux"
+)
+
+// RequestIDHeader carries the request ID, both from a proxy in front of the
+// API and back to the client.
+const RequestIDHeader = "X-Request-ID"
+
+// accessLog collects what RequestLogger logs. AuthMiddleware runs inside
+// it with a request of its own, so it reports the user through the
+// pointer in the context (see WithPrincipal).
+type accessLog struct {
+	user string
+}
+
+type accessLogKey struct{}
+
+// RequestLogger logs every request once it is served: method, route
+// template, status, bytes written, latency, user and request ID. The
+// request ID is taken from X-Request-ID when the client sent a sensible one
+// and generated otherwise; either way it is echoed back and added to every
+// record logged with the request's context.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		entry := &accessLog{}
+		ctx := logging.WithRequestID(r.Context(), id)
+		ctx = context.WithValue(ctx, accessLogKey{}, entry)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		slog.Log(ctx, level, "Request",
+			slog.String("method", r.Method),
+			slog.String("route", routeTemplate(r)),
+			slog.Int("status", recorder.status),
+			slog.Int("bytes", recorder.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start))/float64(time.Millisecond)),
+			slog.String("user", entry.user),
+		)
+	})
+}
+
+// routeTemplate is the path template of the mux route serving r, such as
+// "/webhooks/{id:[0-9]+}", or the path when no route matched.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// validRequestID accepts IDs that are safe to log and echo: short, and
+// only letters, digits and a little punctuation.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the real writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
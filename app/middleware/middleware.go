@@ -1,28 +1,211 @@
 package middleware
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
-	"os"
+	"strings"
 
+	"github.com/capgainschristian/go_api_ds/apikeys"
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/mfa"
+	"github.com/capgainschristian/go_api_ds/sessions"
 	"github.com/golang-jwt/jwt/v5"
 )
 
+type contextKey string
+
+const (
+	principalKey contextKey = "principal"
+	claimsKey    contextKey = "claims"
+)
+
+const (
+	AuthMethodCookie = "cookie"
+	AuthMethodBearer = "bearer"
+	AuthMethodAPIKey = "api_key"
+)
+
+// AuthMiddleware accepts, in order of precedence, a JWT in the Authorization
+// header ("Bearer <jwt>"), an API key in the X-API-Key header, or a JWT in
+// the token cookie. Only the first credential present is considered, so a
+// malformed header is rejected rather than silently falling back to a
+// browser session. Cookie sessions must also send CSRFHeader on requests
+// that change state.
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("token")
+		if key := r.Header.Get(apikeys.Header); key != "" && r.Header.Get("Authorization") == "" {
+			apiKeyAuth(next, w, r, key)
+			return
+		}
+
+		tokenString, method, err := tokenFromRequest(r)
 		if err != nil {
-			http.Error(w, "No token", http.StatusUnauthorized)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		token, err := jwt.Parse(cookie.Value, func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("BCRYPT_KEY")), nil
-		})
+		token, err := keys.Default().Parse(tokenString)
 		if err != nil || !token.Valid {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		claims, _ := token.Claims.(jwt.MapClaims)
+		subject, _ := claims.GetSubject()
+
+		// A challenge token only proves the password, not the second factor.
+		if typ, _ := claims["typ"].(string); typ == mfa.ChallengeType {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		revoked, err := tokenRevoked(r.Context(), subject, claims)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Token revocation check error", "error", err)
+			http.Error(w, "Failed to check token revocation", http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		if !csrfSafe(r, method) && !csrfValid(r, claims) {
+			http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		// Tokens minted before the uid claim existed leave UserID at 0.
+		uid, _ := claims["uid"].(float64)
+		jti, _ := claims["jti"].(string)
+		org, _ := claims["org"].(float64)
+
+		ctx := WithPrincipal(r.Context(), &Principal{
+			UserID:         uint(uid),
+			Email:          subject,
+			Roles:          rolesClaim(token),
+			AuthMethod:     method,
+			TokenID:        jti,
+			MFA:            amrHasOTP(claims),
+			OrganizationID: uint(org),
+		})
+		ctx = context.WithValue(ctx, claimsKey, claims)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// apiKeyAuth authenticates as the key's owner. The key's scopes narrow, and
+// never widen, what the owner's role allows.
+func apiKeyAuth(next http.Handler, w http.ResponseWriter, r *http.Request, key string) {
+	apiKey, user, err := apikeys.Resolve(database.DB.Db, key)
+	if err != nil {
+		if errors.Is(err, apikeys.ErrInvalidKey) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	scopes := []string{}
+	json.Unmarshal(apiKey.Scopes, &scopes)
+
+	ctx := WithPrincipal(r.Context(), &Principal{
+		UserID:         user.ID,
+		Email:          user.Email,
+		Roles:          []string{user.Role},
+		AuthMethod:     AuthMethodAPIKey,
+		TokenID:        apiKey.Prefix,
+		Scopes:         scopes,
+		OrganizationID: apiKey.OrganizationID,
+	})
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func tokenFromRequest(r *http.Request) (string, string, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			return "", "", errors.New("Malformed Authorization header")
+		}
+		return strings.TrimSpace(token), AuthMethodBearer, nil
+	}
+
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		return "", "", errors.New("No token")
+	}
+	return cookie.Value, AuthMethodCookie, nil
+}
+
+// tokenRevoked checks the token against the logout denylist and the
+// user's token generation.
+func tokenRevoked(ctx context.Context, subject string, claims jwt.MapClaims) (bool, error) {
+	jti, _ := claims["jti"].(string)
+
+	revoked, err := sessions.IsRevoked(ctx, cache.RedisClient.Client, jti)
+	if err != nil || revoked {
+		return revoked, err
+	}
+
+	// Tokens minted before generations existed count as generation 0.
+	gen, _ := claims["gen"].(float64)
+
+	current, err := sessions.Generation(ctx, cache.RedisClient.Client, database.DB.Db, subject)
+	if err != nil {
+		return false, err
+	}
+	return int(gen) < current, nil
+}
+
+// Claims returns all claims of the token validated by AuthMiddleware, or
+// nil for API keys.
+func Claims(r *http.Request) jwt.MapClaims {
+	claims, _ := r.Context().Value(claimsKey).(jwt.MapClaims)
+	return claims
+}
+
+func amrHasOTP(claims jwt.MapClaims) bool {
+	raw, _ := claims["amr"].([]interface{})
+	for _, method := range raw {
+		if method == "otp" {
+			return true
+		}
+	}
+	return false
+}
+
+// MFASatisfied reports whether the request meets the 2FA policy: either
+// none of its roles require 2FA, or the session used it. API keys are
+// exempt; they can only be created from a session that satisfies it.
+func MFASatisfied(r *http.Request) (bool, error) {
+	if AuthMethod(r) == AuthMethodAPIKey || MFAVerified(r) {
+		return true, nil
+	}
+
+	required, err := mfa.RequiredFor(database.DB.Db, Roles(r))
+	return !required, err
+}
+
+func rolesClaim(token *jwt.Token) []string {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil
+	}
+
+	raw, _ := claims["roles"].([]interface{})
+	roles := make([]string, 0, len(raw))
+	for _, role := range raw {
+		if s, ok := role.(string); ok {
+			roles = append(roles, s)
+		}
+	}
+	return roles
+}
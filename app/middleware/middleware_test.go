@@ -0,0 +1,244 @@
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/keys"
+	"github.com/capgainschristian/go_api_ds/logging"
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/sessions"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+
+	database.ConnectDb()
+
+	cache.ConnectRedis()
+
+	if err := keys.LoadDefault(); err != nil {
+		slog.Error("Failed to load JWT keys", "error", err)
+		os.Exit(2)
+	}
+
+	code := m.Run()
+
+	os.Exit(code)
+}
+
+// ensureUser makes sure a user with email exists, since tokens naming a
+// subject no user has are refused.
+func ensureUser(t *testing.T, email string) {
+	t.Helper()
+
+	user := models.User{Email: email, Password: "unused", Role: models.RoleViewer}
+	if err := database.DB.Db.Where("email = ?", email).FirstOrCreate(&user).Error; err != nil {
+		t.Fatal("Failed to create user:", err)
+	}
+	// Drop any generation cached while the user didn't exist.
+	sessions.Forget(context.Background(), cache.RedisClient.Client, email)
+}
+
+func signToken(t *testing.T, subject string) string {
+	t.Helper()
+
+	ensureUser(t, subject)
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub": subject,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+	return tokenString
+}
+
+func TestAuthMiddlewareTokenSources(t *testing.T) {
+	var gotSubject, gotMethod string
+	handler := middleware.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSubject = middleware.Subject(r)
+		gotMethod = middleware.AuthMethod(r)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		wantCode      int
+		wantSubject   string
+		wantMethod    string
+	}{
+		{"no token", "", "", http.StatusUnauthorized, "", ""},
+		{"cookie", "", signToken(t, "cookie@example.com"), http.StatusOK, "cookie@example.com", middleware.AuthMethodCookie},
+		{"bearer", "Bearer " + signToken(t, "bearer@example.com"), "", http.StatusOK, "bearer@example.com", middleware.AuthMethodBearer},
+		{"bearer wins over cookie", "Bearer " + signToken(t, "bearer@example.com"), signToken(t, "cookie@example.com"), http.StatusOK, "bearer@example.com", middleware.AuthMethodBearer},
+		{"malformed header does not fall back to cookie", "Basic abc", signToken(t, "cookie@example.com"), http.StatusUnauthorized, "", ""},
+		{"invalid bearer", "Bearer not-a-jwt", "", http.StatusUnauthorized, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSubject, gotMethod = "", ""
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "token", Value: tt.cookie})
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantCode, rr.Code)
+			assert.Equal(t, tt.wantSubject, gotSubject)
+			assert.Equal(t, tt.wantMethod, gotMethod)
+		})
+	}
+}
+
+func TestRequirePermissionWithInjectedPrincipal(t *testing.T) {
+	handler := middleware.RequirePermission(middleware.PermCustomersWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := middleware.CurrentPrincipal(r)
+		w.Write([]byte(p.Email))
+	}))
+
+	tests := []struct {
+		name      string
+		principal *middleware.Principal
+		wantCode  int
+	}{
+		{"no principal", nil, http.StatusForbidden},
+		{"viewer", &middleware.Principal{Email: "viewer@example.com", Roles: []string{"viewer"}, MFA: true}, http.StatusForbidden},
+		{"editor", &middleware.Principal{Email: "editor@example.com", Roles: []string{"editor"}, MFA: true}, http.StatusOK},
+		{"api key without scope", &middleware.Principal{Email: "editor@example.com", Roles: []string{"editor"}, AuthMethod: middleware.AuthMethodAPIKey}, http.StatusForbidden},
+		{"api key with scope", &middleware.Principal{Email: "editor@example.com", Roles: []string{"editor"}, AuthMethod: middleware.AuthMethodAPIKey, Scopes: []string{middleware.PermCustomersWrite}}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.principal != nil {
+				req = req.WithContext(middleware.WithPrincipal(req.Context(), tt.principal))
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantCode, rr.Code)
+			if tt.wantCode == http.StatusOK {
+				assert.Equal(t, tt.principal.Email, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareCSRF(t *testing.T) {
+	handler := middleware.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ensureUser(t, "csrf@example.com")
+	tokenString, err := keys.Default().Sign(jwt.MapClaims{
+		"sub":  "csrf@example.com",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+		"csrf": "expected",
+	})
+	if err != nil {
+		t.Fatal("Failed to sign token:", err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		bearer   bool
+		csrf     string
+		wantCode int
+	}{
+		{"cookie GET needs no token", "GET", false, "", http.StatusOK},
+		{"cookie POST without token", "POST", false, "", http.StatusForbidden},
+		{"cookie POST with wrong token", "POST", false, "wrong", http.StatusForbidden},
+		{"cookie DELETE with token", "DELETE", false, "expected", http.StatusOK},
+		{"bearer POST is exempt", "POST", true, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer "+tokenString)
+			} else {
+				req.AddCookie(&http.Cookie{Name: "token", Value: tokenString})
+			}
+			if tt.csrf != "" {
+				req.Header.Set(middleware.CSRFHeader, tt.csrf)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantCode, rr.Code)
+		})
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(logging.NewHandler(&buf, slog.LevelInfo)))
+	defer slog.SetDefault(previous)
+
+	router := mux.NewRouter()
+	router.Use(middleware.RequestLogger)
+	router.Handle("/things/{id}", middleware.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "Handling")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})))
+
+	send := func(requestID string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/things/42", nil)
+		req.Header.Set("Authorization", "Bearer "+signToken(t, "logged@grahamsummitllc.com"))
+		if requestID != "" {
+			req.Header.Set(middleware.RequestIDHeader, requestID)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("from-the-proxy")
+	assert.Equal(t, "from-the-proxy", rr.Header().Get(middleware.RequestIDHeader))
+
+	var handling, request map[string]interface{}
+	decoder := json.NewDecoder(&buf)
+	decoder.Decode(&handling)
+	decoder.Decode(&request)
+
+	assert.Equal(t, "from-the-proxy", handling["request_id"])
+	assert.Equal(t, "Request", request["msg"])
+	assert.Equal(t, "GET", request["method"])
+	assert.Equal(t, "/things/{id}", request["route"])
+	assert.Equal(t, float64(http.StatusCreated), request["status"])
+	assert.Equal(t, float64(5), request["bytes"])
+	assert.Equal(t, "logged@grahamsummitllc.com", request["user"])
+	assert.Equal(t, "from-the-proxy", request["request_id"])
+	assert.Contains(t, request, "latency_ms")
+
+	// Missing or unusable IDs are replaced.
+	assert.Len(t, send("").Header().Get(middleware.RequestIDHeader), 32)
+	assert.Len(t, send("bad id\n").Header().Get(middleware.RequestIDHeader), 32)
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/ratelimit"
+)
+
+// RateLimit limits the routes of a group, configured by ratelimit.ForGroup
+// with def as the default. Requests are counted per API key or user when
+// the middleware runs after AuthMiddleware, and per IP otherwise.
+func RateLimit(group string, def ratelimit.Limit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := ratelimit.ForGroup(group, def)
+			if limit.Disabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			result, err := ratelimit.Default().Allow(r.Context(), group+":"+rateLimitKey(r), limit)
+			if err != nil {
+				// Both limiters failed; don't lock everyone out over it.
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+				http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKey is who a request counts against: the API key, the user, or
+// failing both the address it came from.
+func rateLimitKey(r *http.Request) string {
+	p := principal(r)
+	switch {
+	case p.AuthMethod == AuthMethodAPIKey && p.TokenID != "":
+		return "key:" + p.TokenID
+	case p.UserID != 0:
+		return "user:" + strconv.FormatUint(uint64(p.UserID), 10)
+	case p.Email != "":
+		return "user:" + p.Email
+	}
+
+	// X-Forwarded-For is not trusted, since any client can set it.
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// seconds rounds d up, so clients never retry too early.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
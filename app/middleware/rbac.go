@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/capgainschristian/go_api_ds/models"
+)
+
+const (
+	PermCustomersRead   = "customers:read"
+	PermCustomersWrite  = "customers:write"
+	PermCustomersDelete = "customers:delete"
+	PermCustomersBulk   = "customers:bulk"
+	PermWebhooksManage  = "webhooks:manage"
+	PermJobsRead        = "jobs:read"
+	PermUsersAdmin      = "users:admin"
+)
+
+// rolePermissions is the single place deciding what each role may do.
+var rolePermissions = map[string][]string{
+	models.RoleViewer: {
+		PermCustomersRead,
+	},
+	models.RoleEditor: {
+		PermCustomersRead,
+		PermCustomersWrite,
+		PermCustomersDelete,
+		PermWebhooksManage,
+		PermJobsRead,
+	},
+	models.RoleAdmin: {
+		PermCustomersRead,
+		PermCustomersWrite,
+		PermCustomersDelete,
+		PermCustomersBulk,
+		PermWebhooksManage,
+		PermJobsRead,
+		PermUsersAdmin,
+	},
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether any of roles grants permission.
+func HasPermission(roles []string, permission string) bool {
+	for _, role := range roles {
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the authenticated request may use permission:
+// its roles must grant it and, for API keys, the key must be scoped to it.
+func Allowed(r *http.Request, permission string) bool {
+	if !HasPermission(Roles(r), permission) {
+		return false
+	}
+	if AuthMethod(r) != AuthMethodAPIKey {
+		return true
+	}
+	for _, scope := range Scopes(r) {
+		if scope == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions lists every permission granted by roles.
+func Permissions(roles []string) []string {
+	seen := map[string]bool{}
+	permissions := []string{}
+	for _, role := range roles {
+		for _, p := range rolePermissions[role] {
+			if !seen[p] {
+				seen[p] = true
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	return permissions
+}
+
+// RequirePermission only lets through requests allowed to use permission,
+// from sessions meeting the 2FA policy. It must run after AuthMiddleware.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !Allowed(r, permission) {
+				writeProblem(w, http.StatusForbidden, "Forbidden", "Missing permission "+permission)
+				return
+			}
+
+			satisfied, err := MFASatisfied(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !satisfied {
+				writeProblem(w, http.StatusForbidden, "Two-factor authentication required",
+					"Your role requires two-factor authentication; enroll at /mfa/totp/enroll and log in again")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// problem is an RFC 7807 problem details body.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, title, detail string) {
+	body, _ := json.Marshal(problem{
+		Type:   "about:blank",
+		Title:  title,
+		Status: status,
+		Detail: detail,
+	})
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
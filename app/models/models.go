@@ -1,17 +1,233 @@
 package models
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Customer struct {
 	gorm.Model
-	Name    string `json:"name" gorm:"type:text;not null;default:null"`
-	Email   string `json:"email" gorm:"primaryKey;type:varchar(100);not null;uniqueIndex"`
-	Address string `json:"address" gorm:"type:text;not null;default:null"`
-	Number  int    `json:"number" gorm:"not null;default:0"`
+	// The organization owning the customer. Emails are only unique within
+	// an organization.
+	OrganizationID uint   `json:"organization_id" gorm:"not null;default:0;uniqueIndex:idx_customers_org_email,priority:1"`
+	Name           string `json:"name" gorm:"type:text;not null;default:null"`
+	Email          string `json:"email" gorm:"primaryKey;type:varchar(100);not null;uniqueIndex:idx_customers_org_email,priority:2"`
+	Address        string `json:"address" gorm:"type:text;not null;default:null"`
+	Number         int    `json:"number" gorm:"not null;default:0"`
+	// Emails of the users who created and last changed the customer. Set
+	// by the handlers from the request's principal, never from the body.
+	CreatedBy string `json:"created_by" gorm:"type:varchar(100)"`
+	UpdatedBy string `json:"updated_by" gorm:"type:varchar(100)"`
 }
 
 type User struct {
 	gorm.Model
-	Email   string `json:"email" gorm:"primaryKey;type:varchar(100);not null;uniqueIndex"`
-	Password string  `json:"password" gorm:"type:text;not null;default:null"`
-}
\ No newline at end of file
+	Email    string `json:"email" gorm:"primaryKey;type:varchar(100);not null;uniqueIndex"`
+	Password string `json:"-" gorm:"type:text;not null;default:null"`
+	Role     string `json:"role" gorm:"type:varchar(20);not null;default:'viewer'"`
+	// Bumped to revoke every token issued to the user so far.
+	TokenGeneration int `json:"-" gorm:"not null;default:0"`
+	// Set once the user follows the link sent at signup. Login refuses
+	// unverified users.
+	EmailVerifiedAt *time.Time `json:"-"`
+	// TOTP two-factor authentication. The secret is stored while enrollment
+	// is pending and only enforced once TOTPEnabledAt is set. TOTPLastStep
+	// is the time step of the last accepted code, so a code can't be
+	// replayed.
+	TOTPSecret    string     `json:"-" gorm:"type:varchar(64)"`
+	TOTPEnabledAt *time.Time `json:"-"`
+	TOTPLastStep  int64      `json:"-" gorm:"not null;default:0"`
+	// The issuer and sub claim of the user's single sign-on identity, if
+	// they have logged in through the identity provider. Together they
+	// identify the user there; the email may change hands.
+	OIDCIssuer  *string `json:"-" gorm:"type:varchar(255);uniqueIndex:idx_users_oidc_identity"`
+	OIDCSubject *string `json:"-" gorm:"type:varchar(255);uniqueIndex:idx_users_oidc_identity"`
+	// Disabled users can't log in or use their API keys.
+	DisabledAt *time.Time `json:"-"`
+}
+
+// Organization is a tenant. Its customers, and everything derived from them,
+// are only visible to its members.
+type Organization struct {
+	gorm.Model
+	Name string `json:"name" gorm:"type:varchar(100);not null;uniqueIndex"`
+}
+
+// OrganizationMember lets a user act in an organization. A user may belong
+// to several and picks one per session.
+type OrganizationMember struct {
+	OrganizationID uint      `json:"organization_id" gorm:"primaryKey"`
+	UserID         uint      `json:"user_id" gorm:"primaryKey;index"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// AuditLog records administrative operations that are not tied to a single
+// request/response, such as bulk deletes and updates.
+type AuditLog struct {
+	gorm.Model
+	Actor     string `json:"actor" gorm:"type:varchar(100);not null;index"`
+	Operation string `json:"operation" gorm:"type:varchar(50);not null"`
+	Details   JSON   `json:"details" gorm:"type:jsonb"`
+}
+
+// Job is a unit of background work claimed and run by the jobs worker pool.
+type Job struct {
+	gorm.Model
+	// The organization the job works for, if any. Only its members can see
+	// the job; jobs with none are internal.
+	OrganizationID uint       `json:"organization_id" gorm:"not null;default:0;index"`
+	Type           string     `json:"type" gorm:"type:varchar(100);not null;index"`
+	Payload        JSON       `json:"payload" gorm:"type:jsonb"`
+	Status         string     `json:"status" gorm:"type:varchar(20);not null;default:'queued';index:idx_jobs_claim,priority:1"`
+	RunAt          time.Time  `json:"run_at" gorm:"not null;index:idx_jobs_claim,priority:2"`
+	Attempts       int        `json:"attempts" gorm:"not null;default:0"`
+	MaxAttempts    int        `json:"max_attempts" gorm:"not null;default:5"`
+	Progress       int        `json:"progress" gorm:"not null;default:0"`
+	LastError      string     `json:"last_error,omitempty" gorm:"type:text"`
+	LockedAt       *time.Time `json:"-"`
+	// ClaimedBy identifies the claim holding the lease, so a worker whose
+	// lease lapsed can't overwrite the outcome of whoever claimed it next.
+	ClaimedBy  string     `json:"-" gorm:"type:varchar(64)"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// CustomerHistory is one entry in a customer's audit trail. Before and After
+// hold full snapshots; Diff holds only the fields that changed.
+type CustomerHistory struct {
+	ID             uint      `json:"id" gorm:"primarykey"`
+	CreatedAt      time.Time `json:"created_at" gorm:"index"`
+	OrganizationID uint      `json:"organization_id" gorm:"not null;default:0;index"`
+	CustomerID     uint      `json:"customer_id" gorm:"not null;index"`
+	Actor          string    `json:"actor" gorm:"type:varchar(100);not null;index"`
+	Operation      string    `json:"operation" gorm:"type:varchar(20);not null"`
+	Before         JSON      `json:"before" gorm:"type:jsonb"`
+	After          JSON      `json:"after" gorm:"type:jsonb"`
+	Diff           JSON      `json:"diff" gorm:"type:jsonb"`
+}
+
+// OutboxEvent is a customer change event waiting to be published. It is
+// written in the same transaction as the change it describes.
+type OutboxEvent struct {
+	ID             uint       `json:"id" gorm:"primarykey"`
+	CreatedAt      time.Time  `json:"created_at"`
+	EventType      string     `json:"event_type" gorm:"type:varchar(50);not null"`
+	SchemaVersion  int        `json:"schema_version" gorm:"not null"`
+	OrganizationID uint       `json:"organization_id" gorm:"not null;default:0"`
+	CustomerID     uint       `json:"customer_id" gorm:"not null;index"`
+	Payload        JSON       `json:"payload" gorm:"type:jsonb;not null"`
+	PublishedAt    *time.Time `json:"published_at" gorm:"index"`
+	// Failed publish attempts. An event the relay gives up on gets FailedAt
+	// and is skipped from then on.
+	Attempts  int        `json:"attempts" gorm:"not null;default:0"`
+	LastError string     `json:"last_error,omitempty" gorm:"type:text"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+}
+
+// WebhookEndpoint is a URL registered by a user to receive the customer
+// events of one organization.
+type WebhookEndpoint struct {
+	gorm.Model
+	OrganizationID      uint       `json:"organization_id" gorm:"not null;default:0;index"`
+	OwnerEmail          string     `json:"owner_email" gorm:"type:varchar(100);not null;index"`
+	URL                 string     `json:"url" gorm:"type:text;not null"`
+	Secret              string     `json:"-" gorm:"type:text;not null"`
+	EventTypes          JSON       `json:"event_types" gorm:"type:jsonb;not null"`
+	Active              bool       `json:"active" gorm:"not null;default:true"`
+	ConsecutiveFailures int        `json:"consecutive_failures" gorm:"not null;default:0"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+}
+
+// WebhookDelivery is the delivery log entry for one event sent to one
+// endpoint, covering every attempt made for it.
+type WebhookDelivery struct {
+	gorm.Model
+	EndpointID   uint       `json:"endpoint_id" gorm:"not null;uniqueIndex:idx_webhook_delivery_event"`
+	EventID      uint       `json:"event_id" gorm:"not null;uniqueIndex:idx_webhook_delivery_event"`
+	EventType    string     `json:"event_type" gorm:"type:varchar(50);not null"`
+	Payload      JSON       `json:"-" gorm:"type:jsonb;not null"`
+	Status       string     `json:"status" gorm:"type:varchar(20);not null;default:'pending'"`
+	Attempts     int        `json:"attempts" gorm:"not null;default:0"`
+	ResponseCode int        `json:"response_code"`
+	LastError    string     `json:"last_error,omitempty" gorm:"type:text"`
+	DeliveredAt  *time.Time `json:"delivered_at,omitempty"`
+}
+
+// RefreshToken is an opaque, single-use token exchanged for a new access
+// token. Only its SHA-256 hash is stored. Every token descends from one
+// login and shares that login's FamilyID, so a whole chain can be revoked.
+type RefreshToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint      `gorm:"not null;index"`
+	FamilyID  string    `gorm:"type:varchar(64);not null;index"`
+	TokenHash string    `gorm:"type:varchar(64);not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	// Whether the login that started the family used a second factor.
+	MFA bool `gorm:"not null;default:false"`
+	// The organization the session acts in.
+	OrganizationID uint `gorm:"not null;default:0"`
+}
+
+// APIKey lets a program act as its owning user, in the organization that
+// was active when it was created. The key itself is shown once at creation;
+// only its SHA-256 hash and a short prefix, to tell keys apart, are stored.
+type APIKey struct {
+	gorm.Model
+	UserID         uint       `json:"user_id" gorm:"not null;index"`
+	OrganizationID uint       `json:"organization_id" gorm:"not null;default:0"`
+	Name           string     `json:"name" gorm:"type:varchar(100);not null"`
+	Prefix         string     `json:"prefix" gorm:"type:varchar(20);not null;index"`
+	KeyHash        string     `json:"-" gorm:"type:varchar(64);not null;uniqueIndex"`
+	Scopes         JSON       `json:"scopes" gorm:"type:jsonb;not null"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+}
+
+// PasswordResetToken lets a user who forgot their password choose a new
+// one. Like refresh tokens, only the SHA-256 hash is stored and each token
+// works once.
+type PasswordResetToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"type:varchar(64);not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+}
+
+// EmailVerificationToken is sent to a new user to prove they own their
+// email address. Only the SHA-256 hash is stored.
+type EmailVerificationToken struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"type:varchar(64);not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+}
+
+// RecoveryCode can be used once instead of a TOTP code, for when the user
+// has lost their authenticator. Only the SHA-256 hash is stored.
+type RecoveryCode struct {
+	ID        uint `gorm:"primarykey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"type:varchar(64);not null;uniqueIndex"`
+	UsedAt    *time.Time
+}
+
+// MFARequirement makes every user with Role use two-factor authentication.
+type MFARequirement struct {
+	Role      string `json:"role" gorm:"primaryKey;type:varchar(20)"`
+	CreatedAt time.Time
+}
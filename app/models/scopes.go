@@ -0,0 +1,16 @@
+package models
+
+import "gorm.io/gorm"
+
+// InOrganization is a GORM scope limiting a query to the rows of one
+// organization. Every query on customers, and on tables derived from them,
+// goes through it:
+//
+//	db.Scopes(models.InOrganization(orgID)).Find(&customers)
+//
+// Organization 0 matches nothing, since no row belongs to it once migrated.
+func InOrganization(orgID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("organization_id = ?", orgID)
+	}
+}
@@ -0,0 +1,107 @@
+package oidc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/models"
+)
+
+// Config describes the identity provider and how its users map onto ours.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// GroupsClaim names the ID token claim listing the user's groups, and
+	// RoleMapping maps group names to roles. Users in no mapped group get
+	// DefaultRole.
+	GroupsClaim string
+	RoleMapping map[string]string
+	DefaultRole string
+}
+
+// ConfigFromEnv reads:
+//
+//	OIDC_ISSUER         issuer URL; SSO is off when unset
+//	OIDC_CLIENT_ID      client registered with the provider
+//	OIDC_CLIENT_SECRET  its secret, if it is a confidential client
+//	OIDC_REDIRECT_URL   default APP_URL + "/oidc/callback"
+//	OIDC_SCOPES         default "openid email profile groups"
+//	OIDC_GROUPS_CLAIM   default "groups"
+//	OIDC_ROLE_MAPPING   e.g. "api-admins=admin,support=editor"
+//	OIDC_DEFAULT_ROLE   default "viewer"
+func ConfigFromEnv() (Config, bool) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return Config{}, false
+	}
+
+	config := Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  envOr("OIDC_REDIRECT_URL", envOr("APP_URL", "http://localhost:3000")+"/oidc/callback"),
+		Scopes:       strings.Fields(envOr("OIDC_SCOPES", "openid email profile groups")),
+		GroupsClaim:  envOr("OIDC_GROUPS_CLAIM", "groups"),
+		RoleMapping:  map[string]string{},
+		DefaultRole:  envOr("OIDC_DEFAULT_ROLE", models.RoleViewer),
+	}
+
+	for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAPPING"), ",") {
+		group, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok {
+			config.RoleMapping[strings.TrimSpace(group)] = strings.TrimSpace(role)
+		}
+	}
+
+	return config, true
+}
+
+// Validate checks that every role the config can hand out exists, so a typo
+// in OIDC_ROLE_MAPPING or OIDC_DEFAULT_ROLE is caught at startup instead of
+// provisioning users with a role that grants nothing, or that a later role
+// of the same name would unexpectedly grant.
+func (c Config) Validate() error {
+	if !middleware.ValidRole(c.DefaultRole) {
+		return fmt.Errorf("oidc: invalid default role %q", c.DefaultRole)
+	}
+	for group, role := range c.RoleMapping {
+		if !middleware.ValidRole(role) {
+			return fmt.Errorf("oidc: invalid role %q for group %q", role, group)
+		}
+	}
+	return nil
+}
+
+// rolePrecedence orders roles from most to least privileged, so a user in
+// several mapped groups gets the strongest role among them.
+var rolePrecedence = []string{models.RoleAdmin, models.RoleEditor, models.RoleViewer}
+
+// Role maps a user's groups to a role.
+func (c Config) Role(groups []string) string {
+	mapped := map[string]bool{}
+	for _, group := range groups {
+		if role, ok := c.RoleMapping[group]; ok {
+			mapped[role] = true
+		}
+	}
+
+	for _, role := range rolePrecedence {
+		if mapped[role] {
+			return role
+		}
+	}
+	return c.DefaultRole
+}
+
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
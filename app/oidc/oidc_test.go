@@ -0,0 +1,130 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/oidc"
+	"github.com/capgainschristian/go_api_ds/oidc/oidctest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newProvider(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	idp, err := oidctest.NewServer("go_api_ds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	provider, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:      idp.URL,
+		ClientID:    "go_api_ds",
+		RedirectURL: "http://localhost:3000/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+		GroupsClaim: "groups",
+		DefaultRole: models.RoleViewer,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp, provider
+}
+
+// authorize follows the login link to the mock provider and returns the
+// code and state it redirects back with.
+func authorize(t *testing.T, authURL string) (string, string) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	idp, provider := newProvider(t)
+	idp.Claims["sub"] = "user-1"
+	idp.Claims["email"] = "sso@grahamsummitllc.com"
+	idp.Claims["email_verified"] = true
+	idp.Claims["groups"] = []string{"support"}
+
+	verifier, _ := oidc.RandomString(32)
+	code, state := authorize(t, provider.AuthCodeURL("the-state", "the-nonce", verifier))
+	assert.Equal(t, "the-state", state)
+
+	// A wrong verifier is refused by the provider.
+	_, err := provider.Exchange(context.Background(), code, "wrong", "the-nonce")
+	assert.Error(t, err)
+
+	code, _ = authorize(t, provider.AuthCodeURL("the-state", "the-nonce", verifier))
+	claims, err := provider.Exchange(context.Background(), code, verifier, "the-nonce")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "user-1", claims.Subject)
+	assert.Equal(t, "sso@grahamsummitllc.com", claims.Email)
+	assert.True(t, *claims.EmailVerified)
+	assert.Equal(t, []string{"support"}, claims.Groups)
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+	idp, provider := newProvider(t)
+	idp.Claims["sub"] = "user-1"
+
+	token, _ := idp.IDToken("the-nonce")
+	_, err := provider.Verify(context.Background(), token, "the-nonce")
+	assert.NoError(t, err)
+
+	_, err = provider.Verify(context.Background(), token, "another-nonce")
+	assert.ErrorIs(t, err, oidc.ErrInvalidToken)
+
+	idp.Claims["aud"] = "someone-else"
+	token, _ = idp.IDToken("the-nonce")
+	_, err = provider.Verify(context.Background(), token, "the-nonce")
+	assert.ErrorIs(t, err, oidc.ErrInvalidToken)
+}
+
+func TestRoleMapping(t *testing.T) {
+	config := oidc.Config{
+		RoleMapping: map[string]string{"api-admins": models.RoleAdmin, "support": models.RoleEditor},
+		DefaultRole: models.RoleViewer,
+	}
+
+	assert.Equal(t, models.RoleViewer, config.Role(nil))
+	assert.Equal(t, models.RoleEditor, config.Role([]string{"support", "everyone"}))
+	assert.Equal(t, models.RoleAdmin, config.Role([]string{"support", "api-admins"}))
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "")
+	_, ok := oidc.ConfigFromEnv()
+	assert.False(t, ok)
+
+	t.Setenv("OIDC_ISSUER", "https://idp.grahamsummitllc.com")
+	t.Setenv("OIDC_ROLE_MAPPING", "api-admins=admin, support=editor")
+	config, ok := oidc.ConfigFromEnv()
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"api-admins": "admin", "support": "editor"}, config.RoleMapping)
+	assert.Equal(t, models.RoleViewer, config.DefaultRole)
+	assert.NoError(t, config.Validate())
+
+	t.Setenv("OIDC_ROLE_MAPPING", "api-admins=administrator")
+	config, _ = oidc.ConfigFromEnv()
+	assert.Error(t, config.Validate())
+
+	t.Setenv("OIDC_ROLE_MAPPING", "")
+	t.Setenv("OIDC_DEFAULT_ROLE", "guest")
+	config, _ = oidc.ConfigFromEnv()
+	assert.Error(t, config.Validate())
+}
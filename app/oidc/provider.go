@@ -0,0 +1,336 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNotConfigured = errors.New("Single sign-on is not configured")
+	ErrInvalidToken  = errors.New("Invalid ID token")
+)
+
+// jwksRefreshInterval limits how often an unknown kid triggers a JWKS
+// refetch, so tokens with made up kids can't hammer the provider.
+const jwksRefreshInterval = time.Minute
+
+// Metadata is the subset of the discovery document we use.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider runs the authorization code flow against one identity provider
+// and validates the ID tokens it issues.
+type Provider struct {
+	Config   Config
+	Metadata Metadata
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// NewProvider validates config and fetches the provider's discovery document.
+func NewProvider(ctx context.Context, config Config, client *http.Client) (*Provider, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	p := &Provider{Config: config, client: client}
+
+	discovery := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, discovery, &p.Metadata); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if p.Metadata.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", p.Metadata.Issuer, config.Issuer)
+	}
+	if p.Metadata.AuthorizationEndpoint == "" || p.Metadata.TokenEndpoint == "" || p.Metadata.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: incomplete provider metadata")
+	}
+
+	return p, nil
+}
+
+var (
+	defaultMu       sync.Mutex
+	defaultProvider *Provider
+)
+
+// Default returns the process wide provider, configured from the
+// environment. Discovery happens on first use and is retried on the next
+// call if it fails.
+func Default(ctx context.Context) (*Provider, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if defaultProvider != nil {
+		return defaultProvider, nil
+	}
+
+	config, ok := ConfigFromEnv()
+	if !ok {
+		return nil, ErrNotConfigured
+	}
+
+	p, err := NewProvider(ctx, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	defaultProvider = p
+	return p, nil
+}
+
+// SetDefault replaces the process wide provider, for tests.
+func SetDefault(p *Provider) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultProvider = p
+}
+
+// AuthCodeURL is where to send the user to log in.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.Config.ClientID)
+	v.Set("redirect_uri", p.Config.RedirectURL)
+	v.Set("scope", strings.Join(p.Config.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", Challenge(verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.Metadata.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.Metadata.AuthorizationEndpoint + sep + v.Encode()
+}
+
+// Claims are the ID token claims used to provision users.
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified *bool
+	Groups        []string
+	AMR           []string
+}
+
+// Exchange trades an authorization code for tokens and returns the
+// validated claims of the ID token.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Config.RedirectURL)
+	form.Set("client_id", p.Config.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.Metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("oidc token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc token endpoint: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return nil, errors.New("oidc token response has no id_token")
+	}
+
+	return p.Verify(ctx, body.IDToken, nonce)
+}
+
+// Verify checks an ID token's signature against the provider's JWKS, its
+// issuer, audience, expiry and nonce.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (*Claims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "ES256"}),
+		jwt.WithIssuer(p.Config.Issuer),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+
+	token, err := parser.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	raw, _ := token.Claims.(jwt.MapClaims)
+	if got, _ := raw["nonce"].(string); got == "" || got != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	claims := &Claims{
+		Groups: stringList(raw[p.Config.GroupsClaim]),
+		AMR:    stringList(raw["amr"]),
+	}
+	claims.Subject, _ = raw.GetSubject()
+	claims.Email, _ = raw["email"].(string)
+	if verified, ok := raw["email_verified"].(bool); ok {
+		claims.EmailVerified = &verified
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// key returns the verification key for kid, refetching the JWKS when the
+// provider has rotated to a key we haven't seen.
+func (p *Provider) key(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.Metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+	p.keysFetched = time.Now()
+
+	p.keys = map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if public, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = public
+		}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package outbox
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"gorm.io/gorm"
+)
+
+const (
+	CustomerCreated = "customer.created"
+	CustomerUpdated = "customer.updated"
+	CustomerDeleted = "customer.deleted"
+
+	// SchemaVersion is bumped whenever Event changes in a way consumers
+	// must know about. It travels with every published message.
+	SchemaVersion = 1
+)
+
+// Event is the versioned envelope published to the stream.
+type Event struct {
+	ID             uint            `json:"id"`
+	Type           string          `json:"type"`
+	Version        int             `json:"version"`
+	OccurredAt     time.Time       `json:"occurred_at"`
+	OrganizationID uint            `json:"organization_id"`
+	CustomerID     uint            `json:"customer_id"`
+	Actor          string          `json:"actor"`
+	Data           json.RawMessage `json:"data"`
+	Changes        json.RawMessage `json:"changes,omitempty"`
+}
+
+// Add stores an event in the outbox. tx must be the transaction making the
+// change so the event exists if, and only if, the change commits. orgID is
+// the organization owning the customer; only its webhooks receive the event.
+func Add(tx *gorm.DB, eventType string, orgID, customerID uint, actor string, data, changes []byte) error {
+	payload, err := json.Marshal(Event{
+		Type:           eventType,
+		Version:        SchemaVersion,
+		OccurredAt:     time.Now().UTC(),
+		OrganizationID: orgID,
+		CustomerID:     customerID,
+		Actor:          actor,
+		Data:           data,
+		Changes:        changes,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&models.OutboxEvent{
+		EventType:      eventType,
+		SchemaVersion:  SchemaVersion,
+		OrganizationID: orgID,
+		CustomerID:     customerID,
+		Payload:        payload,
+	}).Error
+}
@@ -0,0 +1,204 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultStream = "customer-events"
+
+	relayInterval  = time.Second
+	relayBatchSize = 100
+	streamMaxLen   = 100000
+
+	// An event that fails to publish this many times is set aside.
+	maxPublishAttempts = 10
+
+	// Arbitrary key for pg_try_advisory_xact_lock. Only one relay across all
+	// replicas publishes at a time, which keeps the stream in outbox order.
+	relayLockID = 727001
+)
+
+// Relay copies unpublished outbox events to a Redis Stream with XADD.
+//
+// Delivery is at least once: an event is marked published only after XADD
+// succeeds, so a crash in between publishes it again on the next pass.
+// Consumers should de-duplicate on the event id. Events are published in id
+// order and a batch stops at the first failure, so events for the same
+// customer are not reordered. An event that still fails after
+// maxPublishAttempts, say because its payload is too large, is marked failed
+// and skipped so it can't hold up the ones behind it.
+type Relay struct {
+	db     *gorm.DB
+	rdb    *redis.Client
+	stream string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewRelay(db *gorm.DB, rdb *redis.Client, stream string) *Relay {
+	if stream == "" {
+		stream = DefaultStream
+	}
+	return &Relay{db: db, rdb: rdb, stream: stream}
+}
+
+// Stream is the name of the stream events are published to.
+func (r *Relay) Stream() string {
+	return r.stream
+}
+
+// Start runs the relay in the background until Stop is called.
+func (r *Relay) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+
+		for {
+			published, err := r.PublishPending(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "Outbox relay error", "error", err)
+			}
+			if published == relayBatchSize {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(relayInterval):
+			}
+		}
+	}()
+
+	slog.Info("Outbox relay started", "stream", r.stream)
+}
+
+// Stop waits for the current batch to finish, or for ctx to expire.
+func (r *Relay) Stop(ctx context.Context) error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.once.Do(r.cancel)
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PublishPending publishes one batch of unpublished events and returns how
+// many made it to the stream.
+func (r *Relay) PublishPending(ctx context.Context) (int, error) {
+	published := 0
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", relayLockID).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			// Another replica is publishing.
+			return nil
+		}
+
+		events := []models.OutboxEvent{}
+
+		err := tx.Where("published_at IS NULL AND failed_at IS NULL").Order("id").Limit(relayBatchSize).Find(&events).Error
+		if err != nil {
+			return err
+		}
+
+		ids := []uint{}
+		var publishErr error
+		var failed models.OutboxEvent
+
+		for _, event := range events {
+			if publishErr = r.publish(ctx, event); publishErr != nil {
+				failed = event
+				break
+			}
+			ids = append(ids, event.ID)
+		}
+
+		if len(ids) > 0 {
+			err = tx.Model(&models.OutboxEvent{}).Where("id IN ?", ids).Update("published_at", time.Now()).Error
+			if err != nil {
+				return err
+			}
+		}
+		published = len(ids)
+
+		if publishErr != nil {
+			slog.ErrorContext(ctx, "Outbox relay XADD error", "event_id", failed.ID, "error", publishErr)
+			return r.recordFailure(ctx, tx, failed, publishErr)
+		}
+		return nil
+	})
+
+	return published, err
+}
+
+// recordFailure counts a failed attempt against event, and sets it aside
+// once it is out of attempts. Nothing is counted while Redis is unreachable,
+// when every event would fail alike.
+func (r *Relay) recordFailure(ctx context.Context, tx *gorm.DB, event models.OutboxEvent, publishErr error) error {
+	if err := r.rdb.Ping(ctx).Err(); err != nil {
+		return nil
+	}
+
+	updates := map[string]interface{}{
+		"attempts":   gorm.Expr("attempts + 1"),
+		"last_error": publishErr.Error(),
+	}
+	if event.Attempts+1 >= maxPublishAttempts {
+		slog.ErrorContext(ctx, "Outbox relay giving up on event", "event_id", event.ID, "attempts", event.Attempts+1)
+		updates["failed_at"] = time.Now()
+	}
+	return tx.Model(&event).Updates(updates).Error
+}
+
+func (r *Relay) publish(ctx context.Context, event models.OutboxEvent) error {
+	var envelope Event
+	if err := json.Unmarshal(event.Payload, &envelope); err != nil {
+		return err
+	}
+	envelope.ID = event.ID
+	// Events stored before organizations existed only have it on the row.
+	envelope.OrganizationID = event.OrganizationID
+
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	return r.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.stream,
+		MaxLen: streamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"event_id":        strconv.FormatUint(uint64(event.ID), 10),
+			"type":            event.EventType,
+			"version":         event.SchemaVersion,
+			"organization_id": strconv.FormatUint(uint64(event.OrganizationID), 10),
+			"customer_id":     strconv.FormatUint(uint64(event.CustomerID), 10),
+			"payload":         payload,
+		},
+	}).Err()
+}
@@ -0,0 +1,110 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/outbox"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+
+	database.ConnectDb()
+
+	cache.ConnectRedis()
+
+	code := m.Run()
+
+	os.Exit(code)
+}
+
+func TestRelayPublishesInOrder(t *testing.T) {
+	ctx := context.Background()
+	stream := "test-customer-events"
+	cache.RedisClient.Client.Del(ctx, stream)
+
+	// Publish anything left over from earlier runs so only our events remain.
+	relay := outbox.NewRelay(database.DB.Db, cache.RedisClient.Client, stream)
+	for {
+		n, err := relay.PublishPending(ctx)
+		assert.NoError(t, err)
+		if n == 0 {
+			break
+		}
+	}
+	cache.RedisClient.Client.Del(ctx, stream)
+
+	data := []byte(`{"email":"outbox@grahamsummitllc.com"}`)
+	assert.NoError(t, outbox.Add(database.DB.Db, outbox.CustomerCreated, 1, 4242, "tester", data, nil))
+	assert.NoError(t, outbox.Add(database.DB.Db, outbox.CustomerUpdated, 1, 4242, "tester", data, []byte(`{}`)))
+
+	n, err := relay.PublishPending(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	messages, err := cache.RedisClient.Client.XRange(ctx, stream, "-", "+").Result()
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, outbox.CustomerCreated, messages[0].Values["type"])
+		assert.Equal(t, outbox.CustomerUpdated, messages[1].Values["type"])
+
+		var event outbox.Event
+		assert.NoError(t, json.Unmarshal([]byte(messages[0].Values["payload"].(string)), &event))
+		assert.Equal(t, outbox.SchemaVersion, event.Version)
+		assert.Equal(t, uint(4242), event.CustomerID)
+		assert.NotZero(t, event.ID)
+	}
+
+	// Nothing is published twice once marked.
+	n, err = relay.PublishPending(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	var pending int64
+	database.DB.Db.Model(&models.OutboxEvent{}).Where("customer_id = ? AND published_at IS NULL", 4242).Count(&pending)
+	assert.Equal(t, int64(0), pending)
+
+	cache.RedisClient.Client.Del(ctx, stream)
+}
+
+func TestRelaySetsAsideEventsThatKeepFailing(t *testing.T) {
+	ctx := context.Background()
+	stream := "test-customer-events-poison"
+	relay := outbox.NewRelay(database.DB.Db, cache.RedisClient.Client, stream)
+	defer cache.RedisClient.Client.Del(ctx, stream)
+
+	// Publish anything left over from earlier runs.
+	for {
+		n, err := relay.PublishPending(ctx)
+		assert.NoError(t, err)
+		if n == 0 {
+			break
+		}
+	}
+
+	// A payload that isn't an event envelope can never be published.
+	poison := models.OutboxEvent{EventType: outbox.CustomerCreated, SchemaVersion: outbox.SchemaVersion, CustomerID: 4343, Payload: models.JSON(`[1, 2]`)}
+	assert.NoError(t, database.DB.Db.Create(&poison).Error)
+	defer database.DB.Db.Delete(&poison)
+	data := []byte(`{"email":"outbox@grahamsummitllc.com"}`)
+	assert.NoError(t, outbox.Add(database.DB.Db, outbox.CustomerCreated, 1, 4343, "tester", data, nil))
+
+	published := 0
+	for i := 0; i < 20 && published == 0; i++ {
+		n, err := relay.PublishPending(ctx)
+		assert.NoError(t, err)
+		published += n
+	}
+	assert.Equal(t, 1, published, "the event behind the failing one should get through")
+
+	database.DB.Db.First(&poison, poison.ID)
+	assert.NotNil(t, poison.FailedAt)
+	assert.Nil(t, poison.PublishedAt)
+	assert.NotEmpty(t, poison.LastError)
+}
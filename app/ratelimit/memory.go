@@ -0,0 +1,98 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How often MemoryLimiter sweeps out the buckets that have refilled.
+const memorySweepInterval = time.Minute
+
+// MemoryLimiter keeps buckets in this process only. It is the fallback for
+// when Redis is down, and is also handy in tests.
+type MemoryLimiter struct {
+	mu  sync.Mutex
+	tat map[string]time.Time
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewMemoryLimiter starts a limiter, along with the goroutine sweeping it;
+// Close stops the goroutine.
+func NewMemoryLimiter() *MemoryLimiter {
+	l := &MemoryLimiter{tat: map[string]time.Time{}, stop: make(chan struct{})}
+	go l.sweepEvery(memorySweepInterval)
+	return l
+}
+
+// Close stops sweeping. The limiter keeps working, but no longer forgets
+// buckets.
+func (l *MemoryLimiter) Close() {
+	l.once.Do(func() { close(l.stop) })
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if limit.Disabled() {
+		return Result{Allowed: true, Limit: limit.Requests}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	interval := limit.interval()
+
+	tat, ok := l.tat[key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+
+	newTAT := tat.Add(interval)
+	allowAt := newTAT.Add(-limit.Window)
+	if allowAt.After(now) {
+		return Result{
+			Limit:      limit.Requests,
+			Reset:      tat.Sub(now),
+			RetryAfter: allowAt.Sub(now),
+		}, nil
+	}
+
+	l.tat[key] = newTAT
+	return Result{
+		Allowed:   true,
+		Limit:     limit.Requests,
+		Remaining: int((limit.Window - newTAT.Sub(now)) / interval),
+		Reset:     newTAT.Sub(now),
+	}, nil
+}
+
+// sweepEvery runs sweep until Close is called. Sweeping on a timer rather
+// than from Allow keeps requests from paying for a scan of every bucket.
+func (l *MemoryLimiter) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			l.sweep(now)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// sweep forgets buckets that have refilled completely, which behave the
+// same as missing ones.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, tat := range l.tat {
+		if !tat.After(now) {
+			delete(l.tat, key)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Package ratelimit limits how often a client may make requests, using the
+// generic cell rate algorithm (GCRA): a token bucket holding Limit.Requests
+// tokens that refills evenly over Limit.Window. Each key needs a single
+// timestamp of state, which RedisLimiter keeps in Redis so limits hold
+// across replicas.
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/config"
+)
+
+// Limit allows Requests per Window, all of which may come in a burst.
+type Limit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// Disabled reports whether the limit lets everything through.
+func (l Limit) Disabled() bool {
+	return l.Requests <= 0 || l.Window <= 0
+}
+
+// interval is how often one request's worth of capacity comes back.
+func (l Limit) interval() time.Duration {
+	return l.Window / time.Duration(l.Requests)
+}
+
+// ForGroup reads the limit of a route group from RATE_LIMIT_<GROUP>
+// (requests) and RATE_LIMIT_<GROUP>_WINDOW (a duration). Like the login
+// lockout policy, it is read on every call so operators can change it
+// without a restart. Setting the requests to 0 turns the limit off.
+func ForGroup(group string, def Limit) Limit {
+	name := "RATE_LIMIT_" + strings.ToUpper(group)
+	// config.Int refuses 0, which here means off.
+	if os.Getenv(name) == "0" {
+		return Limit{}
+	}
+	return Limit{
+		Requests: config.Int(name, def.Requests),
+		Window:   config.Duration(name+"_WINDOW", def.Window),
+	}
+}
+
+// Result is the outcome of one request against a limit.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long a rejected client has to wait.
+	RetryAfter time.Duration
+}
+
+// Limiter takes one request's worth of capacity from key's bucket, if there
+// is any.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Fallback uses Primary, and Secondary whenever Primary fails, so that an
+// outage of Redis degrades limits to per replica instead of turning them
+// off or failing every request.
+type Fallback struct {
+	Primary   Limiter
+	Secondary Limiter
+}
+
+func (f Fallback) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	result, err := f.Primary.Allow(ctx, key, limit)
+	if err == nil {
+		return result, nil
+	}
+
+	slog.ErrorContext(ctx, "Rate limiter error, falling back to in-memory limits", "error", err)
+	return f.Secondary.Allow(ctx, key, limit)
+}
+
+var (
+	defaultMu      sync.Mutex
+	defaultLimiter Limiter
+)
+
+// Default returns the process wide limiter, created on first use: Redis,
+// falling back to memory.
+func Default() Limiter {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	if defaultLimiter == nil {
+		defaultLimiter = Fallback{
+			Primary:   &RedisLimiter{Client: cache.RedisClient.Client},
+			Secondary: NewMemoryLimiter(),
+		}
+	}
+	return defaultLimiter
+}
+
+// SetDefault replaces the process wide limiter, for tests.
+func SetDefault(l Limiter) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultLimiter = l
+}
@@ -0,0 +1,88 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	limiter := ratelimit.NewMemoryLimiter()
+	defer limiter.Close()
+
+	ctx := context.Background()
+	limit := ratelimit.Limit{Requests: 3, Window: 300 * time.Millisecond}
+
+	// The whole limit may be used in a burst.
+	for remaining := 2; remaining >= 0; remaining-- {
+		result, err := limiter.Allow(ctx, "a", limit)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3, result.Limit)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+
+	result, _ := limiter.Allow(ctx, "a", limit)
+	assert.False(t, result.Allowed)
+	assert.InDelta(t, 100*time.Millisecond, result.RetryAfter, float64(20*time.Millisecond))
+	assert.InDelta(t, 300*time.Millisecond, result.Reset, float64(20*time.Millisecond))
+
+	// Other keys have their own buckets.
+	result, _ = limiter.Allow(ctx, "b", limit)
+	assert.True(t, result.Allowed)
+
+	// Capacity comes back a request at a time.
+	time.Sleep(120 * time.Millisecond)
+	result, _ = limiter.Allow(ctx, "a", limit)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	result, _ = limiter.Allow(ctx, "a", limit)
+	assert.False(t, result.Allowed)
+}
+
+func TestDisabledLimit(t *testing.T) {
+	limiter := ratelimit.NewMemoryLimiter()
+	defer limiter.Close()
+	for i := 0; i < 10; i++ {
+		result, err := limiter.Allow(context.Background(), "a", ratelimit.Limit{Requests: 0, Window: time.Minute})
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+	}
+}
+
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(ctx context.Context, key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("connection refused")
+}
+
+func TestFallback(t *testing.T) {
+	memory := ratelimit.NewMemoryLimiter()
+	defer memory.Close()
+	limiter := ratelimit.Fallback{Primary: failingLimiter{}, Secondary: memory}
+	limit := ratelimit.Limit{Requests: 1, Window: time.Minute}
+
+	result, err := limiter.Allow(context.Background(), "a", limit)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+
+	result, err = limiter.Allow(context.Background(), "a", limit)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+}
+
+func TestForGroup(t *testing.T) {
+	def := ratelimit.Limit{Requests: 10, Window: time.Minute}
+	assert.Equal(t, def, ratelimit.ForGroup("auth", def))
+
+	t.Setenv("RATE_LIMIT_AUTH", "5")
+	t.Setenv("RATE_LIMIT_AUTH_WINDOW", "10s")
+	assert.Equal(t, ratelimit.Limit{Requests: 5, Window: 10 * time.Second}, ratelimit.ForGroup("auth", def))
+
+	t.Setenv("RATE_LIMIT_AUTH", "0")
+	assert.True(t, ratelimit.ForGroup("auth", def).Disabled())
+}
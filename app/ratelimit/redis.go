@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// gcra runs the algorithm atomically on the Redis server, against the
+// server's clock so replicas with skewed clocks agree. The key holds the
+// theoretical arrival time (TAT) of the next request, in microseconds.
+//
+// KEYS[1] bucket, ARGV[1] interval (µs), ARGV[2] burst tolerance (µs)
+// Returns {allowed, remaining, reset (µs), retry after (µs)}.
+var gcra = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local interval = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+	tat = now
+end
+
+local new_tat = tat + interval
+local allow_at = new_tat - tolerance
+if allow_at > now then
+	return {0, 0, tat - now, allow_at - now}
+end
+
+redis.call("SET", KEYS[1], new_tat, "PX", math.ceil((new_tat - now) / 1000))
+return {1, math.floor((tolerance - (new_tat - now)) / interval), new_tat - now, 0}
+`)
+
+// RedisLimiter keeps buckets in Redis, under "ratelimit:<key>".
+type RedisLimiter struct {
+	Client *redis.Client
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if limit.Disabled() {
+		return Result{Allowed: true, Limit: limit.Requests}, nil
+	}
+
+	values, err := gcra.Run(ctx, l.Client, []string{"ratelimit:" + key},
+		limit.interval().Microseconds(), limit.Window.Microseconds()).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Allowed:    values[0] == 1,
+		Limit:      limit.Requests,
+		Remaining:  int(values[1]),
+		Reset:      time.Duration(values[2]) * time.Microsecond,
+		RetryAfter: time.Duration(values[3]) * time.Microsecond,
+	}, nil
+}
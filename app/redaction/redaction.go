@@ -0,0 +1,163 @@
+// Package redaction hides customer fields from roles that may read
+// customers but not every detail of them.
+package redaction
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/capgainschristian/go_api_ds/models"
+)
+
+const (
+	// Omit drops the field from the response.
+	Omit = "omit"
+	// LastTwo replaces every character but the last two with *.
+	LastTwo = "last2"
+)
+
+// How revealing each rule is, for when a user's roles disagree.
+var ruleRank = map[string]int{
+	Omit:    0,
+	LastTwo: 1,
+}
+
+// customerFields is the single place deciding which customer fields, by
+// their JSON names, each role gets redacted. Roles not listed, and fields
+// not listed for a role, are shown in full.
+var customerFields = map[string]map[string]string{
+	models.RoleViewer: {
+		"address": Omit,
+		"number":  LastTwo,
+	},
+}
+
+// Policy maps JSON field names to the rule redacting them.
+type Policy map[string]string
+
+// ForRoles is the policy for a user with roles. A field is only redacted
+// if every role redacts it, and then by the most revealing rule among them.
+func ForRoles(roles []string) Policy {
+	policy := Policy{}
+	if len(roles) == 0 {
+		return policy
+	}
+
+	for field, rule := range customerFields[roles[0]] {
+		policy[field] = rule
+	}
+	for _, role := range roles[1:] {
+		rules := customerFields[role]
+		for field, rule := range policy {
+			other, ok := rules[field]
+			if !ok {
+				delete(policy, field)
+			} else if ruleRank[other] > ruleRank[rule] {
+				policy[field] = other
+			}
+		}
+	}
+	return policy
+}
+
+// Empty reports whether the policy shows everything.
+func (p Policy) Empty() bool {
+	return len(p) == 0
+}
+
+// Apply redacts the fields of one decoded customer in place.
+func (p Policy) Apply(fields map[string]interface{}) {
+	for field, rule := range p {
+		value, ok := fields[field]
+		if !ok {
+			continue
+		}
+		switch rule {
+		case Omit:
+			delete(fields, field)
+		case LastTwo:
+			fields[field] = mask(value)
+		}
+	}
+}
+
+// Customers redacts a JSON array of customers.
+func (p Policy) Customers(raw []byte) ([]byte, error) {
+	if p.Empty() {
+		return raw, nil
+	}
+
+	var customers []map[string]interface{}
+	if err := decode(raw, &customers); err != nil {
+		return nil, err
+	}
+	for _, customer := range customers {
+		p.Apply(customer)
+	}
+	return json.Marshal(customers)
+}
+
+// Customer redacts a JSON customer object, as stored in history entries.
+// null stays null.
+func (p Policy) Customer(raw []byte) ([]byte, error) {
+	if p.Empty() || len(raw) == 0 || string(raw) == "null" {
+		return raw, nil
+	}
+
+	var customer map[string]interface{}
+	if err := decode(raw, &customer); err != nil {
+		return nil, err
+	}
+	p.Apply(customer)
+	return json.Marshal(customer)
+}
+
+// Diff redacts a history diff, a JSON object of field names to their
+// before and after values.
+func (p Policy) Diff(raw []byte) ([]byte, error) {
+	if p.Empty() || len(raw) == 0 || string(raw) == "null" {
+		return raw, nil
+	}
+
+	var diff map[string]map[string]interface{}
+	if err := decode(raw, &diff); err != nil {
+		return nil, err
+	}
+	for field, rule := range p {
+		change, ok := diff[field]
+		if !ok {
+			continue
+		}
+		switch rule {
+		case Omit:
+			delete(diff, field)
+		case LastTwo:
+			for k, v := range change {
+				change[k] = mask(v)
+			}
+		}
+	}
+	return json.Marshal(diff)
+}
+
+// decode keeps numbers as they were written, so masking an int doesn't go
+// through float64.
+func decode(raw []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func mask(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	s := fmt.Sprint(value)
+	if len(s) <= 2 {
+		return s
+	}
+	return strings.Repeat("*", len(s)-2) + s[len(s)-2:]
+}
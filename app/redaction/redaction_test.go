@@ -0,0 +1,47 @@
+package redaction_test
+
+import (
+	"testing"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/redaction"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForRoles(t *testing.T) {
+	assert.True(t, redaction.ForRoles(nil).Empty())
+	assert.True(t, redaction.ForRoles([]string{models.RoleEditor}).Empty())
+	assert.Equal(t, redaction.Policy{"address": redaction.Omit, "number": redaction.LastTwo},
+		redaction.ForRoles([]string{models.RoleViewer}))
+
+	// Any role allowed to see a field shows it.
+	assert.True(t, redaction.ForRoles([]string{models.RoleViewer, models.RoleAdmin}).Empty())
+}
+
+func TestCustomers(t *testing.T) {
+	raw := []byte(`[{"name":"Christian Graham","address":"777 Summit LLC Drive","number":123456},{"name":"Short","address":"1 Road","number":7}]`)
+
+	redacted, err := redaction.ForRoles([]string{models.RoleViewer}).Customers(raw)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"name":"Christian Graham","number":"****56"},{"name":"Short","number":"7"}]`, string(redacted))
+
+	unchanged, err := redaction.ForRoles([]string{models.RoleEditor}).Customers(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, raw, unchanged)
+}
+
+func TestHistory(t *testing.T) {
+	policy := redaction.ForRoles([]string{models.RoleViewer})
+
+	customer, err := policy.Customer([]byte(`{"name":"A","address":"Somewhere","number":1111}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"name":"A","number":"**11"}`, string(customer))
+
+	deleted, err := policy.Customer([]byte(`null`))
+	assert.NoError(t, err)
+	assert.Equal(t, "null", string(deleted))
+
+	diff, err := policy.Diff([]byte(`{"name":{"before":"A","after":"B"},"address":{"before":"X","after":"Y"},"number":{"before":1111,"after":2222}}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"name":{"before":"A","after":"B"},"number":{"before":"**11","after":"**22"}}`, string(diff))
+}
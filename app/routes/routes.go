@@ -2,23 +2,111 @@ package routes
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/capgainschristian/go_api_ds/handlers"
+	"github.com/capgainschristian/go_api_ds/metrics"
 	"github.com/capgainschristian/go_api_ds/middleware"
+	"github.com/capgainschristian/go_api_ds/ratelimit"
 	"github.com/gorilla/mux"
 )
 
 func SetupRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.Use(middleware.RequestLogger, middleware.Instrument)
 
 	r.HandleFunc("/healthcheck", handlers.HealthCheck).Methods("GET")
-	r.HandleFunc("/signup", handlers.SignUp).Methods("POST")
-	r.HandleFunc("/login", handlers.Login).Methods("POST")
-	r.HandleFunc("/customercreation", handlers.AddCustomer).Methods("POST")
-	r.HandleFunc("/listcustomers", handlers.ListCustomers).Methods("GET")
-	r.Handle("/addcustomer", middleware.AuthMiddleware(http.HandlerFunc(handlers.AddCustomer))).Methods("POST")
-	r.Handle("/deletecustomer", middleware.AuthMiddleware(http.HandlerFunc(handlers.DeleteCustomer))).Methods("DELETE")
-	r.Handle("/updatecustomer", middleware.AuthMiddleware(http.HandlerFunc(handlers.UpdateCustomer))).Methods("PUT")
+	r.Handle("/metrics", middleware.RateLimit("metrics", metricsLimit)(metrics.Handler())).Methods("GET")
+	r.HandleFunc("/.well-known/jwks.json", handlers.JWKS).Methods("GET")
+	r.Handle("/signup", public(handlers.SignUp)).Methods("POST")
+	r.Handle("/login", public(handlers.Login)).Methods("POST")
+	r.Handle("/login/mfa", public(handlers.LoginMFA)).Methods("POST")
+	r.Handle("/oidc/login", public(handlers.OIDCLogin)).Methods("GET")
+	r.Handle("/oidc/callback", public(handlers.OIDCCallback)).Methods("GET")
+	r.Handle("/oidc/link", authenticated(handlers.OIDCLink)).Methods("POST")
+	r.Handle("/token/refresh", public(handlers.RefreshToken)).Methods("POST")
+	r.Handle("/password/forgot", public(handlers.ForgotPassword)).Methods("POST")
+	r.Handle("/password/reset", public(handlers.ResetPassword)).Methods("POST")
+	r.Handle("/verify-email", public(handlers.VerifyEmail)).Methods("GET")
+	r.Handle("/verify-email/resend", public(handlers.ResendVerification)).Methods("POST")
+	r.Handle("/logout", authenticated(handlers.Logout)).Methods("POST")
+	r.Handle("/mfa/totp/enroll", authenticated(handlers.EnrollTOTP)).Methods("POST")
+	r.Handle("/mfa/totp/confirm", authenticated(handlers.ConfirmTOTP)).Methods("POST")
+	r.Handle("/mfa/totp", authenticated(handlers.DisableTOTP)).Methods("DELETE")
+	r.Handle("/mfa/policy", protected(middleware.PermUsersAdmin, handlers.GetMFAPolicy)).Methods("GET")
+	r.Handle("/mfa/policy", protected(middleware.PermUsersAdmin, handlers.UpdateMFAPolicy)).Methods("PUT")
+	r.Handle("/listcustomers", tenant(middleware.PermCustomersRead, handlers.ListCustomers)).Methods("GET")
+	r.Handle("/addcustomer", tenant(middleware.PermCustomersWrite, handlers.AddCustomer)).Methods("POST")
+	r.Handle("/deletecustomer", tenant(middleware.PermCustomersDelete, handlers.DeleteCustomer)).Methods("DELETE")
+	r.Handle("/updatecustomer", tenant(middleware.PermCustomersWrite, handlers.UpdateCustomer)).Methods("PUT")
+	r.Handle("/apikeys", authenticated(handlers.CreateAPIKey)).Methods("POST")
+	r.Handle("/apikeys", authenticated(handlers.ListAPIKeys)).Methods("GET")
+	r.Handle("/apikeys/{id:[0-9]+}", authenticated(handlers.RevokeAPIKey)).Methods("DELETE")
+	r.Handle("/customers/{id:[0-9]+}/history", tenant(middleware.PermCustomersRead, handlers.CustomerHistory)).Methods("GET")
+	r.Handle("/webhooks", tenant(middleware.PermWebhooksManage, handlers.CreateWebhook)).Methods("POST")
+	r.Handle("/webhooks", tenant(middleware.PermWebhooksManage, handlers.ListWebhooks)).Methods("GET")
+	r.Handle("/webhooks/{id:[0-9]+}", tenant(middleware.PermWebhooksManage, handlers.UpdateWebhook)).Methods("PUT")
+	r.Handle("/webhooks/{id:[0-9]+}", tenant(middleware.PermWebhooksManage, handlers.DeleteWebhook)).Methods("DELETE")
+	r.Handle("/webhooks/{id:[0-9]+}/deliveries", tenant(middleware.PermWebhooksManage, handlers.ListWebhookDeliveries)).Methods("GET")
+	r.Handle("/webhooks/deliveries/{id:[0-9]+}/redeliver", tenant(middleware.PermWebhooksManage, handlers.RedeliverWebhook)).Methods("POST")
+	r.Handle("/jobs/{id:[0-9]+}", tenant(middleware.PermJobsRead, handlers.GetJob)).Methods("GET")
+	r.Handle("/users/me", authenticated(handlers.GetMe)).Methods("GET")
+	r.Handle("/users/me", authenticated(handlers.UpdateMe)).Methods("PATCH")
+	r.Handle("/users/me/password", authenticated(handlers.ChangePassword)).Methods("POST")
+	r.Handle("/users", protected(middleware.PermUsersAdmin, handlers.ListUsers)).Methods("GET")
+	r.Handle("/users/{id:[0-9]+}", protected(middleware.PermUsersAdmin, handlers.UpdateUser)).Methods("PATCH")
+	r.Handle("/users/{id:[0-9]+}", protected(middleware.PermUsersAdmin, handlers.DeleteUser)).Methods("DELETE")
+	r.Handle("/users/{id:[0-9]+}/sessions", protected(middleware.PermUsersAdmin, handlers.RevokeUserSessions)).Methods("DELETE")
+	r.Handle("/orgs", authenticated(handlers.ListOrganizations)).Methods("GET")
+	r.Handle("/orgs", protected(middleware.PermUsersAdmin, handlers.CreateOrganization)).Methods("POST")
+	r.Handle("/orgs/{id:[0-9]+}/members", protected(middleware.PermUsersAdmin, handlers.AddOrganizationMember)).Methods("POST")
+	r.Handle("/orgs/{id:[0-9]+}/members/{user_id:[0-9]+}", protected(middleware.PermUsersAdmin, handlers.RemoveOrganizationMember)).Methods("DELETE")
+	r.Handle("/orgs/{id:[0-9]+}/switch", authenticated(handlers.SwitchOrganization)).Methods("POST")
+	r.Handle("/bulkdeletecustomers", tenant(middleware.PermCustomersBulk, handlers.BulkDeleteCustomers)).Methods("DELETE")
+	r.Handle("/bulkupdatecustomers", tenant(middleware.PermCustomersBulk, handlers.BulkUpdateCustomers)).Methods("PUT")
 
 	return r
 }
+
+// RegisterSeedEndpoints adds routes that write data without authentication,
+// for loading fake customers into a development database. cmd/main.go only
+// calls it when started with --enable-seed-endpoints and APP_ENV=development.
+func RegisterSeedEndpoints(r *mux.Router) {
+	r.HandleFunc("/seed/customers", handlers.SeedCustomer).Methods("POST")
+}
+
+// Default limits of the route groups, see ratelimit.ForGroup. Logging in
+// and friends are limited per IP, everything else per user or API key, and
+// more loosely per IP. Scrapers of /metrics are limited per IP.
+var (
+	authLimit    = ratelimit.Limit{Requests: 10, Window: time.Minute}
+	apiLimit     = ratelimit.Limit{Requests: 600, Window: time.Minute}
+	clientLimit  = ratelimit.Limit{Requests: 1200, Window: time.Minute}
+	metricsLimit = ratelimit.Limit{Requests: 60, Window: time.Minute}
+)
+
+// public is for routes anyone may call, which are limited by the "auth"
+// rate limit group.
+func public(handler http.HandlerFunc) http.Handler {
+	return middleware.RateLimit("auth", authLimit)(handler)
+}
+
+// authenticated requires a valid token, and counts the request against the
+// "api" rate limit group. Requests are first counted per IP against the
+// "client" group, so requests with invalid tokens, which never reach the
+// "api" group, are limited too.
+func authenticated(handler http.HandlerFunc) http.Handler {
+	return middleware.RateLimit("client", clientLimit)(
+		middleware.AuthMiddleware(middleware.RateLimit("api", apiLimit)(handler)))
+}
+
+// protected requires a valid token whose roles grant permission.
+func protected(permission string, handler http.HandlerFunc) http.Handler {
+	return authenticated(middleware.RequirePermission(permission)(handler).ServeHTTP)
+}
+
+// tenant is protected for routes working on an organization's data, which
+// also need the token to name an organization.
+func tenant(permission string, handler http.HandlerFunc) http.Handler {
+	return protected(permission, middleware.RequireOrganization(handler).ServeHTTP)
+}
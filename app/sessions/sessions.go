@@ -0,0 +1,122 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/config"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+// Access tokens are stateless JWTs, so revoking one early needs server side
+// state. Two mechanisms cover the cases:
+//
+//   - a denylist of token ids (the jti claim), for logging out one session;
+//   - a per-user generation counter (the gen claim), for revoking every
+//     session a user has. Tokens minted before the bump carry an older
+//     generation and are refused.
+//
+// Both live in Redis. The generation is also stored on the user row, which
+// stays the source of truth if the Redis key is evicted.
+
+// generationTTL is how long a cached generation is kept. It must outlast any
+// access token, with room for the leeway the token parser allows, or a
+// revoked subject's tokens would be accepted again once the key expires.
+func generationTTL() time.Duration {
+	return max(config.AccessTokenTTL(), 24*time.Hour) + time.Minute
+}
+
+func denylistKey(jti string) string {
+	return "auth:denylist:" + jti
+}
+
+func generationKey(email string) string {
+	return "auth:generation:" + email
+}
+
+// Revoke denies the token with id jti until it would have expired anyway.
+func Revoke(ctx context.Context, rdb *redis.Client, jti string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if jti == "" || ttl <= 0 {
+		return nil
+	}
+	return rdb.Set(ctx, denylistKey(jti), 1, ttl).Err()
+}
+
+// IsRevoked reports whether the token with id jti was revoked.
+func IsRevoked(ctx context.Context, rdb *redis.Client, jti string) (bool, error) {
+	if jti == "" {
+		return false, nil
+	}
+	n, err := rdb.Exists(ctx, denylistKey(jti)).Result()
+	return n > 0, err
+}
+
+// revokedGeneration is newer than any token's, refusing them all.
+const revokedGeneration = math.MaxInt32
+
+// Generation returns the current token generation for a user. An email no
+// user has gets revokedGeneration, so tokens for a deleted user stay refused
+// once their Redis key is gone.
+func Generation(ctx context.Context, rdb *redis.Client, db *gorm.DB, email string) (int, error) {
+	cached, err := rdb.Get(ctx, generationKey(email)).Result()
+	if err == nil {
+		if gen, err := strconv.Atoi(cached); err == nil {
+			return gen, nil
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+
+	user := new(models.User)
+	err = db.Select("token_generation").Where("email = ?", email).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user.TokenGeneration = revokedGeneration
+	} else if err != nil {
+		return 0, err
+	}
+
+	rdb.Set(ctx, generationKey(email), user.TokenGeneration, generationTTL())
+	return user.TokenGeneration, nil
+}
+
+// RevokeAll invalidates every access and refresh token issued to user so far.
+func RevokeAll(ctx context.Context, rdb *redis.Client, db *gorm.DB, user *models.User) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Update("token_generation", gorm.Expr("token_generation + 1")).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&models.RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", user.ID).
+			Update("revoked_at", time.Now()).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	err = db.Select("token_generation").First(user, user.ID).Error
+	if err != nil {
+		return err
+	}
+	return rdb.Set(ctx, generationKey(user.Email), user.TokenGeneration, generationTTL()).Err()
+}
+
+// RevokeSubject refuses every token naming email as its subject, after the
+// user with that email was deleted or changed address. It outlasts any
+// access token, which is all that needs covering: refresh tokens are tied to
+// the user's id, not their email.
+func RevokeSubject(ctx context.Context, rdb *redis.Client, email string) error {
+	return rdb.Set(ctx, generationKey(email), revokedGeneration, generationTTL()).Err()
+}
+
+// Forget drops the cached generation for email, before a new user takes the
+// address over.
+func Forget(ctx context.Context, rdb *redis.Client, email string) error {
+	return rdb.Del(ctx, generationKey(email)).Err()
+}
@@ -0,0 +1,153 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress is returned for receivers on loopback, private,
+// link-local or otherwise internal addresses, which would let anyone who
+// can manage webhooks probe the network the API runs in.
+var ErrForbiddenAddress = errors.New("webhook receivers must be on a public address")
+
+// allowPrivateNetworks reports whether WEBHOOK_ALLOW_PRIVATE_NETWORKS is
+// "true", which lifts the restriction so receivers on localhost can be
+// used in development and tests. Never set it in production.
+func allowPrivateNetworks() bool {
+	return os.Getenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS") == "true"
+}
+
+// nonPublicNetworks are the reserved ranges the net.IP predicates in PublicIP
+// don't cover.
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8",       // "this network"
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, and the broadcast address
+	"64:ff9b:1::/48",  // local use NAT64
+	"2001:db8::/32",   // documentation
+)
+
+// nat64Prefix is the well-known NAT64 prefix; the IPv4 address it embeds
+// decides whether the address is public.
+var nat64Prefix = parseCIDRs("64:ff9b::/96")[0]
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// PublicIP reports whether ip may receive webhooks. IPv4 addresses embedded
+// in IPv4-mapped or NAT64 IPv6 addresses are judged as IPv4.
+func PublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if nat64Prefix.Contains(ip) {
+		return PublicIP(ip[12:16])
+	}
+
+	if ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateURL checks that rawURL is an absolute http(s) URL whose host
+// only resolves to public addresses. It is a courtesy to the user
+// registering the endpoint; the dialer enforces the same rule on every
+// delivery, as DNS can change in between.
+func ValidateURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("Webhook url must be an absolute http(s) URL")
+	}
+	if allowPrivateNetworks() {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return errors.New("Webhook url host could not be resolved")
+	}
+	for _, addr := range addrs {
+		if !PublicIP(addr.IP) {
+			return errors.New("Webhook url must not point to a private, loopback or link-local address")
+		}
+	}
+	return nil
+}
+
+// dialControl runs after DNS resolution, just before each connection is
+// made, so it sees the address actually dialled and a rebinding DNS server
+// can't slip an internal address past ValidateURL.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	if allowPrivateNetworks() {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !PublicIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// newClient is the delivery client. It ignores proxy settings, which would
+// hide the receiver's address from dialControl, and doesn't follow
+// redirects, which could point anywhere; a redirect counts as a failed
+// delivery.
+func newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialControl,
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
@@ -0,0 +1,162 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/jobs"
+	"github.com/capgainschristian/go_api_ds/models"
+	"gorm.io/gorm"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusRetrying  = "retrying"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+	StatusSkipped   = "skipped"
+
+	// An endpoint is disabled after this many failed attempts in a row,
+	// across all of its deliveries.
+	disableAfterFailures = 15
+)
+
+// Client sends deliveries. Receivers get 10 seconds to answer, and must be
+// on public addresses (see ErrForbiddenAddress).
+var Client = newClient()
+
+type deliverPayload struct {
+	DeliveryID uint `json:"delivery_id"`
+}
+
+// DeliverJob sends one delivery. Retries and their exponential backoff are
+// handled by the jobs pool.
+var DeliverJob = jobs.Type[deliverPayload]{Name: "webhooks.deliver"}
+
+// RegisterJobs installs the webhook job handlers. Call it before starting the
+// jobs pool.
+func RegisterJobs(db *gorm.DB) {
+	jobs.Register(DeliverJob, func(ctx context.Context, job *jobs.Job, p deliverPayload) error {
+		return Deliver(ctx, db, p.DeliveryID, job.Attempts >= job.MaxAttempts)
+	})
+}
+
+// Redeliver queues another round of attempts for an existing delivery of an
+// endpoint in organization orgID.
+func Redeliver(db *gorm.DB, orgID uint, delivery *models.WebhookDelivery) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(delivery).Updates(map[string]interface{}{
+			"status":     StatusPending,
+			"last_error": "",
+		}).Error
+		if err != nil {
+			return err
+		}
+		_, err = DeliverJob.EnqueueIn(tx, orgID, deliverPayload{DeliveryID: delivery.ID})
+		return err
+	})
+}
+
+// Deliver makes a single attempt at sending a delivery and records the
+// outcome. final says whether this is the last attempt the caller will make.
+// A non-nil error means the attempt failed and is worth retrying.
+func Deliver(ctx context.Context, db *gorm.DB, deliveryID uint, final bool) error {
+	delivery := new(models.WebhookDelivery)
+	if err := db.First(delivery, deliveryID).Error; err != nil {
+		return err
+	}
+
+	endpoint := new(models.WebhookEndpoint)
+	if err := db.First(endpoint, delivery.EndpointID).Error; err != nil {
+		return err
+	}
+
+	if !endpoint.Active {
+		return db.Model(delivery).Update("status", StatusSkipped).Error
+	}
+
+	code, sendErr := send(ctx, endpoint, delivery)
+
+	updates := map[string]interface{}{
+		"attempts":      gorm.Expr("attempts + 1"),
+		"response_code": code,
+	}
+
+	if sendErr == nil {
+		now := time.Now()
+		updates["status"] = StatusDelivered
+		updates["last_error"] = ""
+		updates["delivered_at"] = now
+
+		err := db.Model(delivery).Updates(updates).Error
+		if err != nil {
+			return err
+		}
+		return db.Model(endpoint).Update("consecutive_failures", 0).Error
+	}
+
+	disabled := endpoint.ConsecutiveFailures+1 >= disableAfterFailures
+
+	updates["last_error"] = sendErr.Error()
+	if final || disabled {
+		updates["status"] = StatusFailed
+	} else {
+		updates["status"] = StatusRetrying
+	}
+
+	err := db.Model(delivery).Updates(updates).Error
+	if err != nil {
+		return err
+	}
+
+	endpointUpdates := map[string]interface{}{
+		"consecutive_failures": gorm.Expr("consecutive_failures + 1"),
+	}
+	if disabled {
+		slog.Warn("Disabling webhook endpoint after consecutive failures", "endpoint_id", endpoint.ID, "failures", disableAfterFailures)
+		endpointUpdates["active"] = false
+		endpointUpdates["disabled_at"] = time.Now()
+	}
+	err = db.Model(endpoint).Updates(endpointUpdates).Error
+	if err != nil {
+		return err
+	}
+
+	if disabled {
+		// No point retrying against a disabled endpoint.
+		return nil
+	}
+	return sendErr
+}
+
+func send(ctx context.Context, endpoint *models.WebhookEndpoint, delivery *models.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go_api_ds-webhooks/1")
+	req.Header.Set("X-Webhook-Id", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set(SignatureHeader, Sign(endpoint.Secret, time.Now(), body))
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
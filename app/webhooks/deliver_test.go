@@ -0,0 +1,222 @@
+package webhooks_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/capgainschristian/go_api_ds/webhooks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+
+	database.ConnectDb()
+	cache.ConnectRedis()
+
+	code := m.Run()
+
+	os.Exit(code)
+}
+
+func newDelivery(t *testing.T, url string) (models.WebhookEndpoint, models.WebhookDelivery) {
+	t.Helper()
+
+	endpoint := models.WebhookEndpoint{
+		OwnerEmail: "webhooks@grahamsummitllc.com",
+		URL:        url,
+		Secret:     "test-secret",
+		EventTypes: models.JSON(`["customer.created"]`),
+		Active:     true,
+	}
+	if err := database.DB.Db.Create(&endpoint).Error; err != nil {
+		t.Fatal("Failed to create endpoint:", err)
+	}
+
+	delivery := models.WebhookDelivery{
+		EndpointID: endpoint.ID,
+		EventID:    uint(time.Now().UnixNano() % 1000000000),
+		EventType:  "customer.created",
+		Payload:    models.JSON(`{"type":"customer.created"}`),
+		Status:     webhooks.StatusPending,
+	}
+	if err := database.DB.Db.Create(&delivery).Error; err != nil {
+		t.Fatal("Failed to create delivery:", err)
+	}
+
+	t.Cleanup(func() {
+		database.DB.Db.Unscoped().Delete(&delivery)
+		database.DB.Db.Unscoped().Delete(&endpoint)
+	})
+
+	return endpoint, delivery
+}
+
+func TestDeliverSignsPayload(t *testing.T) {
+	// The receiver is on localhost.
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "true")
+
+	var signatureErr error
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signatureErr = webhooks.Verify("test-secret", r.Header.Get(webhooks.SignatureHeader), body, time.Minute)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	_, delivery := newDelivery(t, receiver.URL)
+
+	err := webhooks.Deliver(context.Background(), database.DB.Db, delivery.ID, false)
+	assert.NoError(t, err)
+	assert.NoError(t, signatureErr)
+
+	database.DB.Db.First(&delivery, delivery.ID)
+	assert.Equal(t, webhooks.StatusDelivered, delivery.Status)
+	assert.Equal(t, http.StatusNoContent, delivery.ResponseCode)
+	assert.Equal(t, 1, delivery.Attempts)
+}
+
+func TestDeliverRecordsFailuresAndDisablesEndpoint(t *testing.T) {
+	// The receiver is on localhost.
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "true")
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	endpoint, delivery := newDelivery(t, receiver.URL)
+
+	err := webhooks.Deliver(context.Background(), database.DB.Db, delivery.ID, false)
+	assert.Error(t, err)
+
+	database.DB.Db.First(&delivery, delivery.ID)
+	assert.Equal(t, webhooks.StatusRetrying, delivery.Status)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.ResponseCode)
+
+	// Push the endpoint to the edge of being disabled.
+	database.DB.Db.Model(&endpoint).Update("consecutive_failures", 14)
+
+	err = webhooks.Deliver(context.Background(), database.DB.Db, delivery.ID, false)
+	assert.NoError(t, err, "no retry once the endpoint is disabled")
+
+	database.DB.Db.First(&endpoint, endpoint.ID)
+	assert.False(t, endpoint.Active)
+	assert.NotNil(t, endpoint.DisabledAt)
+
+	database.DB.Db.First(&delivery, delivery.ID)
+	assert.Equal(t, webhooks.StatusFailed, delivery.Status)
+}
+
+func TestVerifyRejectsTamperedAndStalePayloads(t *testing.T) {
+	body := []byte(`{"id":1}`)
+
+	header := webhooks.Sign("secret", time.Now(), body)
+	assert.NoError(t, webhooks.Verify("secret", header, body, time.Minute))
+	assert.ErrorIs(t, webhooks.Verify("secret", header, []byte(`{"id":2}`), time.Minute), webhooks.ErrInvalidSignature)
+	assert.ErrorIs(t, webhooks.Verify("other", header, body, time.Minute), webhooks.ErrInvalidSignature)
+
+	stale := webhooks.Sign("secret", time.Now().Add(-time.Hour), body)
+	assert.ErrorIs(t, webhooks.Verify("secret", stale, body, time.Minute), webhooks.ErrInvalidSignature)
+}
+
+func TestDeliverRefusesInternalAddresses(t *testing.T) {
+	called := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer receiver.Close()
+
+	_, delivery := newDelivery(t, receiver.URL)
+
+	err := webhooks.Deliver(context.Background(), database.DB.Db, delivery.ID, false)
+	assert.ErrorIs(t, err, webhooks.ErrForbiddenAddress)
+	assert.False(t, called)
+}
+
+func TestDeliverDoesNotFollowRedirects(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "true")
+
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	receiver := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer receiver.Close()
+
+	_, delivery := newDelivery(t, receiver.URL)
+
+	err := webhooks.Deliver(context.Background(), database.DB.Db, delivery.ID, false)
+	assert.Error(t, err)
+	assert.False(t, redirected)
+
+	database.DB.Db.First(&delivery, delivery.ID)
+	assert.Equal(t, http.StatusTemporaryRedirect, delivery.ResponseCode)
+}
+
+func TestValidateURL(t *testing.T) {
+	ctx := context.Background()
+
+	for _, url := range []string{
+		"ftp://example.com/hook",
+		"/relative",
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+		"http://100.64.0.1/hook",
+		"http://[::ffff:10.0.0.5]/hook",
+	} {
+		assert.Error(t, webhooks.ValidateURL(ctx, url), url)
+	}
+
+	assert.NoError(t, webhooks.ValidateURL(ctx, "https://93.184.216.34/hook"))
+
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", "true")
+	assert.NoError(t, webhooks.ValidateURL(ctx, "http://127.0.0.1:8080/hook"))
+}
+
+func TestPublicIP(t *testing.T) {
+	for _, addr := range []string{
+		"0.1.2.3",
+		"100.64.0.1",
+		"100.127.255.254",
+		"192.0.0.8",
+		"198.18.0.1",
+		"198.19.255.255",
+		"240.0.0.1",
+		"255.255.255.255",
+		"::ffff:127.0.0.1",
+		"::ffff:10.0.0.5",
+		"::ffff:169.254.169.254",
+		"64:ff9b::a00:5",
+		"64:ff9b::7f00:1",
+		"64:ff9b::a9fe:a9fe",
+		"fd00::1",
+		"fe80::1",
+	} {
+		assert.False(t, webhooks.PublicIP(net.ParseIP(addr)), addr)
+	}
+
+	for _, addr := range []string{
+		"93.184.216.34",
+		"100.128.0.1",
+		"::ffff:93.184.216.34",
+		"64:ff9b::5db8:d822",
+		"2606:2800:220:1:248:1893:25c8:1946",
+	} {
+		assert.True(t, webhooks.PublicIP(net.ParseIP(addr)), addr)
+	}
+}
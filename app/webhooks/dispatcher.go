@@ -0,0 +1,283 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/models"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	consumerGroup = "webhooks"
+
+	// A message that fails to dispatch stays pending and is retried after
+	// dispatchRetryDelay, doubling with each attempt. After
+	// maxDispatchAttempts it is moved to the dead letter stream.
+	maxDispatchAttempts = 5
+	dispatchRetryDelay  = 10 * time.Second
+	maxDispatchRetry    = 10 * time.Minute
+
+	// How often pending messages, including those left behind by a crashed
+	// replica, are checked for retries.
+	pendingInterval = 10 * time.Second
+)
+
+// Dispatcher reads customer events from the outbox stream through a consumer
+// group and fans each one out to the endpoints subscribed to its type, as a
+// delivery row plus a DeliverJob. Messages are acknowledged only after that
+// transaction commits, and the (endpoint, event) unique index makes replays
+// harmless.
+type Dispatcher struct {
+	db       *gorm.DB
+	rdb      *redis.Client
+	stream   string
+	consumer string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewDispatcher(db *gorm.DB, rdb *redis.Client, stream string) *Dispatcher {
+	consumer, err := os.Hostname()
+	if err != nil {
+		consumer = "webhooks"
+	}
+	return &Dispatcher{db: db, rdb: rdb, stream: stream, consumer: consumer}
+}
+
+// DeadLetterStream is where messages that could not be dispatched after
+// maxDispatchAttempts end up, with the reason, for someone to look at.
+func (d *Dispatcher) DeadLetterStream() string {
+	return d.stream + ":dead"
+}
+
+func (d *Dispatcher) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.done = make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+
+		err := d.rdb.XGroupCreateMkStream(ctx, d.stream, consumerGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			slog.ErrorContext(ctx, "Webhook dispatcher failed to create consumer group", "error", err)
+			return
+		}
+
+		// New messages are always read, so a message that keeps failing
+		// can't hold up the ones behind it; failed ones are retried on the
+		// side by RetryPending.
+		var lastRetry time.Time
+		for ctx.Err() == nil {
+			if time.Since(lastRetry) >= pendingInterval {
+				if err := d.RetryPending(ctx); err != nil && ctx.Err() == nil {
+					slog.ErrorContext(ctx, "Webhook dispatcher retry error", "error", err)
+				}
+				lastRetry = time.Now()
+			}
+
+			streams, err := d.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    consumerGroup,
+				Consumer: d.consumer,
+				Streams:  []string{d.stream, ">"},
+				Count:    50,
+				Block:    pendingInterval,
+			}).Result()
+			if err != nil {
+				if !errors.Is(err, redis.Nil) && ctx.Err() == nil {
+					slog.ErrorContext(ctx, "Webhook dispatcher XREADGROUP error", "error", err)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+
+			for _, message := range streams[0].Messages {
+				d.handle(ctx, message)
+			}
+		}
+	}()
+}
+
+// handle dispatches a message and acknowledges it if that worked. Failed
+// messages stay pending for RetryPending.
+func (d *Dispatcher) handle(ctx context.Context, message redis.XMessage) {
+	if err := d.dispatch(message); err != nil {
+		slog.ErrorContext(ctx, "Webhook dispatcher error", "message_id", message.ID, "error", err)
+		return
+	}
+	d.rdb.XAck(ctx, d.stream, consumerGroup, message.ID)
+}
+
+// RetryPending goes through every message of the group that was read but
+// never acknowledged, by this or any other consumer. Messages whose backoff
+// has passed are claimed and dispatched again; those out of attempts are
+// moved to the dead letter stream and acknowledged.
+func (d *Dispatcher) RetryPending(ctx context.Context) error {
+	start := "-"
+	for {
+		pending, err := d.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: d.stream,
+			Group:  consumerGroup,
+			Idle:   dispatchRetryDelay,
+			Start:  start,
+			End:    "+",
+			Count:  100,
+		}).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range pending {
+			if entry.RetryCount >= maxDispatchAttempts {
+				if err := d.giveUp(ctx, entry); err != nil {
+					return err
+				}
+				continue
+			}
+
+			wait := dispatchBackoff(entry.RetryCount)
+			if entry.Idle < wait {
+				continue
+			}
+
+			// MinIdle makes the claim fail if another replica got there
+			// first.
+			claimed, err := d.rdb.XClaim(ctx, &redis.XClaimArgs{
+				Stream:   d.stream,
+				Group:    consumerGroup,
+				Consumer: d.consumer,
+				MinIdle:  wait,
+				Messages: []string{entry.ID},
+			}).Result()
+			if err != nil {
+				return err
+			}
+			for _, message := range claimed {
+				d.handle(ctx, message)
+			}
+		}
+
+		if len(pending) < 100 {
+			return nil
+		}
+		start = "(" + pending[len(pending)-1].ID
+	}
+}
+
+// giveUp copies a message to the dead letter stream and acknowledges it.
+func (d *Dispatcher) giveUp(ctx context.Context, entry redis.XPendingExt) error {
+	messages, err := d.rdb.XRange(ctx, d.stream, entry.ID, entry.ID).Result()
+	if err != nil {
+		return err
+	}
+
+	slog.ErrorContext(ctx, "Webhook dispatcher giving up on message", "message_id", entry.ID, "attempts", entry.RetryCount)
+
+	// The message may have been trimmed from the stream already.
+	if len(messages) > 0 {
+		values := map[string]interface{}{
+			"message_id": entry.ID,
+			"attempts":   entry.RetryCount,
+		}
+		for k, v := range messages[0].Values {
+			values[k] = v
+		}
+		err = d.rdb.XAdd(ctx, &redis.XAddArgs{Stream: d.DeadLetterStream(), Values: values}).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	return d.rdb.XAck(ctx, d.stream, consumerGroup, entry.ID).Err()
+}
+
+// dispatchBackoff is how long a message that has been read attempts times
+// waits before it is tried again.
+func dispatchBackoff(attempts int64) time.Duration {
+	d := dispatchRetryDelay
+	for i := int64(1); i < attempts && d < maxDispatchRetry; i++ {
+		d *= 2
+	}
+	if d > maxDispatchRetry {
+		return maxDispatchRetry
+	}
+	return d
+}
+
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	if d.cancel == nil {
+		return nil
+	}
+	d.once.Do(d.cancel)
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) dispatch(message redis.XMessage) error {
+	eventType, _ := message.Values["type"].(string)
+	payload, _ := message.Values["payload"].(string)
+	rawID, _ := message.Values["event_id"].(string)
+	rawOrgID, _ := message.Values["organization_id"].(string)
+	eventID, err := strconv.ParseUint(rawID, 10, 64)
+	orgID, orgErr := strconv.ParseUint(rawOrgID, 10, 64)
+	if err != nil || orgErr != nil || eventType == "" || payload == "" {
+		// Malformed messages can never be delivered; drop them. That
+		// includes messages published before events carried their
+		// organization, which can't be routed to the right tenant.
+		slog.Warn("Webhook dispatcher skipping malformed message", "message_id", message.ID)
+		return nil
+	}
+
+	subscribed, _ := json.Marshal([]string{eventType})
+
+	endpoints := []models.WebhookEndpoint{}
+	// Only the organization owning the customer may hear about it.
+	err = d.db.Scopes(models.InOrganization(uint(orgID))).
+		Where("active AND event_types @> ?::jsonb", string(subscribed)).Find(&endpoints).Error
+	if err != nil {
+		return err
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		for _, endpoint := range endpoints {
+			delivery := models.WebhookDelivery{
+				EndpointID: endpoint.ID,
+				EventID:    uint(eventID),
+				EventType:  eventType,
+				Payload:    models.JSON(payload),
+				Status:     StatusPending,
+			}
+
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&delivery)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				// Already fanned out on an earlier read.
+				continue
+			}
+
+			if _, err := DeliverJob.EnqueueIn(tx, endpoint.OrganizationID, deliverPayload{DeliveryID: delivery.ID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
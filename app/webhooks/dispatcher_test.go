@@ -0,0 +1,46 @@
+package webhooks_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/capgainschristian/go_api_ds/cache"
+	"github.com/capgainschristian/go_api_ds/database"
+	"github.com/capgainschristian/go_api_ds/webhooks"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherDeadLettersMessagesOutOfAttempts(t *testing.T) {
+	ctx := context.Background()
+	rdb := cache.RedisClient.Client
+	stream := fmt.Sprintf("test:webhooks:%d", time.Now().UnixNano())
+	dispatcher := webhooks.NewDispatcher(database.DB.Db, rdb, stream)
+	t.Cleanup(func() { rdb.Del(ctx, stream, dispatcher.DeadLetterStream()) })
+
+	assert.NoError(t, rdb.XGroupCreateMkStream(ctx, stream, "webhooks", "0").Err())
+	id, err := rdb.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: map[string]interface{}{"type": "customer.created"}}).Result()
+	assert.NoError(t, err)
+
+	// Read it, then pretend it has failed on every attempt so far.
+	assert.NoError(t, rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: "webhooks", Consumer: "crashed", Streams: []string{stream, ">"}, Count: 1,
+	}).Err())
+	assert.NoError(t, rdb.Do(ctx, "XCLAIM", stream, "webhooks", "crashed", 0, id,
+		"IDLE", time.Hour.Milliseconds(), "RETRYCOUNT", 5).Err())
+
+	assert.NoError(t, dispatcher.RetryPending(ctx))
+
+	pending, err := rdb.XPending(ctx, stream, "webhooks").Result()
+	assert.NoError(t, err)
+	assert.Zero(t, pending.Count, "the message should be acknowledged")
+
+	dead, err := rdb.XRange(ctx, dispatcher.DeadLetterStream(), "-", "+").Result()
+	assert.NoError(t, err)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, id, dead[0].Values["message_id"])
+		assert.Equal(t, "customer.created", dead[0].Values["type"])
+	}
+}